@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+)
+
+// maxJobs is the number of jobs kept in memory for polling
+const maxJobs = 100
+
+type jobState string
+
+const (
+	jobQueued    jobState = "queued"
+	jobRunning   jobState = "running"
+	jobSucceeded jobState = "succeeded"
+	jobFailed    jobState = "failed"
+)
+
+// refreshRequest is the body of a POST /admin/refresh request
+type refreshRequest struct {
+	// Archive to refresh, all the archives if empty
+	Archive string `json:"archive"`
+	// Pocket to refresh, requires Archive. All the pockets if empty.
+	Pocket string `json:"pocket"`
+	// Force re-imports everything, ignoring the cached hashes
+	Force bool `json:"force"`
+}
+
+// job is a refresh triggered through the admin API
+type job struct {
+	ID      string         `json:"id"`
+	Request refreshRequest `json:"request"`
+	State   jobState       `json:"state"`
+	// Archive being refreshed when running
+	Archive  string    `json:"archive,omitempty"`
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Files    int       `json:"files"`
+	Packages int       `json:"packages"`
+	Errors   []string  `json:"errors,omitempty"`
+	// Reports of the archives refreshed, by name
+	Reports map[string]*archive.RefreshReport `json:"reports,omitempty"`
+}
+
+// copy returns a copy of the job that can be read while the job keeps
+// running, the mutex of the handler must be held
+func (j *job) copy() job {
+	jobCopy := *j
+	jobCopy.Errors = slices.Clone(j.Errors)
+	if j.Reports != nil {
+		jobCopy.Reports = maps.Clone(j.Reports)
+	}
+
+	return jobCopy
+}
+
+type adminHandler struct {
+	server *server
+
+	mutex sync.Mutex
+	jobs  map[string]*job
+	// order of creation of the jobs, to forget the oldest ones
+	jobIDs []string
+	// jobs waiting to be run, one at a time. It's never closed, the
+	// requests still running after the shutdown may send jobs.
+	queue chan *job
+	// closed is set once the handler is stopped, new jobs are rejected
+	closed bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newAdminHandler(s *server) *adminHandler {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &adminHandler{
+		server: s,
+		jobs:   make(map[string]*job),
+		queue:  make(chan *job, maxJobs),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(h.done)
+		for {
+			select {
+			case j := <-h.queue:
+				h.run(j)
+			case <-h.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return h
+}
+
+// stop interrupts the running job and waits for it to return, the other
+// jobs are dropped and the new ones rejected. It can be called several
+// times.
+func (h *adminHandler) stop() {
+	h.mutex.Lock()
+	h.closed = true
+	h.mutex.Unlock()
+
+	h.cancel()
+	<-h.done
+}
+
+func (h *adminHandler) authorized(r *http.Request, adminToken string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the API is disabled without a token
+	adminToken := h.server.AdminToken()
+	if adminToken == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !h.authorized(r, adminToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == "/admin/refresh" {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h.refresh(w, r)
+		return
+	}
+
+	if id, ok := strings.CutPrefix(r.URL.Path, "/admin/jobs/"); ok {
+		h.mutex.Lock()
+		j, ok := h.jobs[id]
+		var jobCopy job
+		if ok {
+			jobCopy = j.copy()
+		}
+		h.mutex.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, jobCopy)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (h *adminHandler) refresh(w http.ResponseWriter, r *http.Request) {
+	req := refreshRequest{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Pocket != "" && req.Archive == "" {
+		http.Error(w, "pocket requires archive", http.StatusBadRequest)
+		return
+	}
+
+	if len(selectCaches(h.server.Caches(), req.Archive)) == 0 {
+		http.Error(w, "unknown archive", http.StatusNotFound)
+		return
+	}
+
+	j, ok := h.newJob(req)
+	if !ok {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case h.queue <- j:
+	default:
+		h.updateJob(j, func(j *job) {
+			j.State = jobFailed
+			j.Errors = []string{"too many jobs queued"}
+		})
+		http.Error(w, "too many jobs queued", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, struct {
+		ID string `json:"id"`
+	}{j.ID})
+}
+
+// selectCaches returns the archive named name, all of them if name is empty
+func selectCaches(caches []*archive.Archive, name string) []*archive.Archive {
+	selected := make([]*archive.Archive, 0)
+	for _, cache := range caches {
+		if name == "" || name == cache.Name {
+			selected = append(selected, cache)
+		}
+	}
+
+	return selected
+}
+
+// newJob adds a queued job, false if the handler is stopped
+func (h *adminHandler) newJob(req refreshRequest) (*job, bool) {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	j := &job{
+		ID:      hex.EncodeToString(id),
+		Request: req,
+		State:   jobQueued,
+		Created: time.Now(),
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return nil, false
+	}
+	h.jobs[j.ID] = j
+	h.jobIDs = append(h.jobIDs, j.ID)
+	if len(h.jobIDs) > maxJobs {
+		delete(h.jobs, h.jobIDs[0])
+		h.jobIDs = h.jobIDs[1:]
+	}
+
+	return j, true
+}
+
+func (h *adminHandler) updateJob(j *job, update func(*job)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	update(j)
+}
+
+// run refreshes the archives one after the other, RefreshCache makes
+// sure that it doesn't run concurrently with the scheduled refreshes.
+// The archives are looked up again as the configuration may have been
+// reloaded since the job was queued.
+func (h *adminHandler) run(j *job) {
+	if h.ctx.Err() != nil {
+		h.updateJob(j, func(j *job) {
+			j.State = jobFailed
+			j.Errors = []string{"server shutting down"}
+		})
+		return
+	}
+
+	opts := archive.RefreshOptions{Force: j.Request.Force}
+	if j.Request.Pocket != "" {
+		opts.Pockets = []string{j.Request.Pocket}
+	}
+
+	h.updateJob(j, func(j *job) {
+		j.State = jobRunning
+		j.Started = time.Now()
+	})
+
+	caches := selectCaches(h.server.Caches(), j.Request.Archive)
+	if len(caches) == 0 {
+		h.updateJob(j, func(j *job) {
+			j.Errors = append(j.Errors, "unknown archive")
+		})
+	}
+
+	for _, cache := range caches {
+		if h.ctx.Err() != nil {
+			h.updateJob(j, func(j *job) {
+				j.Errors = append(j.Errors, "server shutting down")
+			})
+			break
+		}
+
+		h.updateJob(j, func(j *job) {
+			j.Archive = cache.Name
+		})
+
+		report, err := refreshCache(h.ctx, cache, opts)
+
+		h.updateJob(j, func(j *job) {
+			if j.Reports == nil {
+				j.Reports = make(map[string]*archive.RefreshReport)
+			}
+			j.Reports[cache.Name] = report
+			j.Files += report.Files()
+			j.Packages += report.Packages()
+			if err != nil {
+				j.Errors = append(j.Errors, cache.Name+": "+err.Error())
+			}
+		})
+	}
+
+	h.updateJob(j, func(j *job) {
+		j.Archive = ""
+		j.Finished = time.Now()
+		j.State = jobSucceeded
+		if len(j.Errors) != 0 {
+			j.State = jobFailed
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/gjolly/go-rmadison/pkg/database"
+	"github.com/go-resty/resty/v2"
+)
+
+const testAdminToken = "secret"
+
+// newTestAdmin returns an admin handler serving n archives downloaded
+// from upstream
+func newTestAdmin(t *testing.T, n int, upstreamHandler http.Handler) *adminHandler {
+	upstream := httptest.NewServer(upstreamHandler)
+	t.Cleanup(upstream.Close)
+	baseURL, err := url.Parse(upstream.URL + "/dists")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{adminToken: testAdminToken}
+	for i := 0; i < n; i++ {
+		s.caches = append(s.caches, &archive.Archive{
+			Name:     fmt.Sprintf("archive%v", i),
+			BaseURL:  baseURL,
+			PortsURL: baseURL,
+			Pockets:  []string{"noble"},
+			CacheDir: t.TempDir(),
+			Client:   resty.New(),
+			Database: database.NewMemory(),
+		})
+	}
+
+	h := newAdminHandler(s)
+	t.Cleanup(h.stop)
+
+	return h
+}
+
+func adminRequest(h *adminHandler, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+// startJob queues a refresh and returns the ID of its job
+func startJob(t *testing.T, h *adminHandler, body string) string {
+	w := adminRequest(h, http.MethodPost, "/admin/refresh", body)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status %v: %v", w.Code, w.Body.String())
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return created.ID
+}
+
+func TestAdminPollRunningJob(t *testing.T) {
+	h := newTestAdmin(t, 20, http.NotFoundHandler())
+	id := startJob(t, h, "")
+
+	// polling reads the job while it's updated, run with -race
+	deadline := time.Now().Add(time.Minute)
+	for {
+		w := adminRequest(h, http.MethodGet, "/admin/jobs/"+id, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %v", w.Code)
+		}
+
+		var j job
+		err := json.Unmarshal(w.Body.Bytes(), &j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.State == jobSucceeded || j.State == jobFailed {
+			if len(j.Reports) != 20 {
+				t.Errorf("expected 20 reports, got %v", len(j.Reports))
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %v", j.State)
+		}
+	}
+}
+
+func TestAdminStopped(t *testing.T) {
+	h := newTestAdmin(t, 1, http.NotFoundHandler())
+	h.stop()
+
+	// the requests still running after the shutdown are rejected
+	w := adminRequest(h, http.MethodPost, "/admin/refresh", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once stopped, got %v", w.Code)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := newTestAdmin(t, 1, http.NotFoundHandler())
+
+	tests := []struct {
+		name          string
+		authorization string
+		expected      int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"not bearer", "Basic " + testAdminToken, http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"token", "Bearer " + testAdminToken, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/jobs/unknown", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, w.Code)
+			}
+		})
+	}
+
+	// the API is disabled without a token in the config
+	h.server.adminToken = ""
+	w := adminRequest(h, http.MethodPost, "/admin/refresh", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a token configured, got %v", w.Code)
+	}
+}
+
+func TestAdminUnknownArchive(t *testing.T) {
+	h := newTestAdmin(t, 1, http.NotFoundHandler())
+
+	w := adminRequest(h, http.MethodPost, "/admin/refresh", `{"archive": "nope"}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown archive, got %v", w.Code)
+	}
+	w = adminRequest(h, http.MethodPost, "/admin/refresh", `{"pocket": "noble"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a pocket without archive, got %v", w.Code)
+	}
+
+	// the archive was removed from the config once the job is run
+	j, _ := h.newJob(refreshRequest{Archive: "removed"})
+	h.run(j)
+	jobCopy := j.copy()
+	if jobCopy.State != jobFailed || len(jobCopy.Errors) != 1 || jobCopy.Errors[0] != "unknown archive" {
+		t.Errorf("unexpected job %+v", jobCopy)
+	}
+}
+
+func TestAdminQueue(t *testing.T) {
+	// the first job blocks the queue until the end of the test
+	release := make(chan struct{})
+	h := newTestAdmin(t, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(func() { close(release) })
+
+	first := startJob(t, h, "")
+	for {
+		w := adminRequest(h, http.MethodGet, "/admin/jobs/"+first, "")
+		var j job
+		err := json.Unmarshal(w.Body.Bytes(), &j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.State == jobRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < maxJobs; i++ {
+		startJob(t, h, "")
+	}
+	w := adminRequest(h, http.MethodPost, "/admin/refresh", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with a full queue, got %v", w.Code)
+	}
+
+	// only the last maxJobs jobs are kept
+	w = adminRequest(h, http.MethodGet, "/admin/jobs/"+first, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the oldest job to be forgotten, got %v", w.Code)
+	}
+	h.mutex.Lock()
+	n := len(h.jobs)
+	h.mutex.Unlock()
+	if n != maxJobs {
+		t.Errorf("expected %v jobs, got %v", maxJobs, n)
+	}
+}
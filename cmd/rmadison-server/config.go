@@ -0,0 +1,557 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/gjolly/go-rmadison/pkg/database"
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the rmadison server
+type Config struct {
+	Caches []*archive.Archive
+	// Schedules are the refresh schedules of the archives, by name
+	Schedules map[string]*refreshSchedule
+	// AdminToken protects the admin API, disabled if empty
+	AdminToken string
+	// InsertOptions are the options of the SQL databases of the
+	// archives, by name
+	InsertOptions map[string]database.InsertOptions
+}
+
+// close closes the databases of the archives
+func (c *Config) close() {
+	for _, cache := range c.Caches {
+		if cache == nil || cache.Database == nil {
+			continue
+		}
+		err := cache.Database.Close()
+		if err != nil {
+			log.Errorf("failed to close database of %v: %v", cache.Name, err)
+		}
+	}
+}
+
+type adminYAMLConf struct {
+	Token *secretYAMLConf `yaml:"token"`
+}
+
+type archiveYAMLConf struct {
+	// Name identifies the archive, defaults to BaseURL
+	Name     string `yaml:"name"`
+	BaseURL  string `yaml:"base_url"`
+	PortsURL string `yaml:"ports_url"`
+	// Mirrors are tried in order before BaseURL
+	Mirrors []string `yaml:"mirrors"`
+	// ArchitectureURLs overrides the Ubuntu amd64/i386 vs ports mapping
+	ArchitectureURLs map[string]string  `yaml:"architecture_urls"`
+	Database         string             `yaml:"database"`
+	Pockets          []string           `yaml:"pockets"`
+	Discover         *discoveryYAMLConf `yaml:"discover"`
+
+	Components    filterYAMLConf `yaml:"components"`
+	Architectures filterYAMLConf `yaml:"architectures"`
+
+	Auth *authYAMLConf `yaml:"auth"`
+
+	Refresh refreshYAMLConf `yaml:"refresh"`
+
+	Import importYAMLConf `yaml:"import"`
+}
+
+// importYAMLConf tunes how the packages are written to the SQL
+// databases, by the imports and the refreshes
+type importYAMLConf struct {
+	MultiRowValues bool `yaml:"multi_row_values"`
+	Tune           bool `yaml:"tune"`
+}
+
+func (i importYAMLConf) toInsertOptions() database.InsertOptions {
+	options := database.DefaultInsertOptions
+	options.MultiRowValues = i.MultiRowValues
+	options.Tune = i.Tune
+
+	return options
+}
+
+type refreshYAMLConf struct {
+	Interval   time.Duration `yaml:"interval"`
+	Schedule   string        `yaml:"schedule"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	Jitter     time.Duration `yaml:"jitter"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+func (r refreshYAMLConf) toSchedule() (*refreshSchedule, error) {
+	schedule := &refreshSchedule{
+		Interval:   r.Interval,
+		MaxBackoff: r.MaxBackoff,
+		Jitter:     r.Jitter,
+		Timeout:    r.Timeout,
+	}
+
+	if schedule.Interval < 0 || schedule.MaxBackoff < 0 || schedule.Jitter < 0 || schedule.Timeout < 0 {
+		return nil, errors.New("durations must be positive")
+	}
+	if schedule.Interval == 0 {
+		schedule.Interval = defaultRefreshInterval
+	}
+	if schedule.MaxBackoff == 0 {
+		schedule.MaxBackoff = defaultMaxBackoff
+	}
+
+	if r.Schedule != "" {
+		cronSchedule, err := cron.ParseStandard(r.Schedule)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid schedule")
+		}
+		schedule.Cron = cronSchedule
+	}
+
+	return schedule, nil
+}
+
+type authYAMLConf struct {
+	Username   string          `yaml:"username"`
+	Password   *secretYAMLConf `yaml:"password"`
+	Token      *secretYAMLConf `yaml:"token"`
+	AuthConf   string          `yaml:"auth_conf"`
+	ClientCert string          `yaml:"client_cert"`
+	ClientKey  string          `yaml:"client_key"`
+	CACert     string          `yaml:"ca_cert"`
+}
+
+// secretYAMLConf is a secret read from a file or from an environment
+// variable, secrets are never written in the config file itself
+type secretYAMLConf struct {
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+func (s *secretYAMLConf) read() (string, error) {
+	if s == nil {
+		return "", nil
+	}
+
+	if s.File != "" && s.Env != "" {
+		return "", errors.New("file and env are mutually exclusive")
+	}
+
+	if s.File != "" {
+		content, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	if s.Env != "" {
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %v is not set", s.Env)
+		}
+		return value, nil
+	}
+
+	return "", errors.New("one of file or env is required")
+}
+
+func (a *authYAMLConf) toAuth() (*archive.Auth, error) {
+	if a == nil {
+		return nil, nil
+	}
+
+	password, err := a.Password.read()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read password")
+	}
+
+	token, err := a.Token.read()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read token")
+	}
+
+	var authConf []archive.AuthConfEntry
+	if a.AuthConf != "" {
+		authConf, err = archive.ReadAuthConf(a.AuthConf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &archive.Auth{
+		Username:   a.Username,
+		Password:   password,
+		Token:      token,
+		AuthConf:   authConf,
+		ClientCert: a.ClientCert,
+		ClientKey:  a.ClientKey,
+		CACert:     a.CACert,
+	}, nil
+}
+
+type filterYAMLConf struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+func (f filterYAMLConf) toFilter() archive.Filter {
+	return archive.Filter{
+		Include: f.Include,
+		Exclude: f.Exclude,
+	}
+}
+
+type discoveryYAMLConf struct {
+	Codenames []string `yaml:"codenames"`
+	Suffixes  []string `yaml:"suffixes"`
+
+	filterYAMLConf `yaml:",inline"`
+}
+
+// serverYAMLConf is the content of the config file
+type serverYAMLConf struct {
+	CacheDirectory string             `yaml:"cache_directory"`
+	Archives       []*archiveYAMLConf `yaml:"archives"`
+	Admin          adminYAMLConf      `yaml:"admin"`
+}
+
+// defaultConfigPaths are the config files tried in order when none is
+// given
+func defaultConfigPaths() []string {
+	configPaths := []string{
+		"server.yaml",
+		"/etc/rmadison/server",
+	}
+	userConfigDir, err := os.UserConfigDir()
+	if err == nil {
+		configPaths = append(configPaths, path.Join(userConfigDir, "rmadison", "server.yaml"))
+	}
+
+	return configPaths
+}
+
+// readConfigFile decodes the config file at configPath, or the first one
+// found in the default locations if empty. If strict is set, unknown
+// fields are errors. Returns the path of the file read. On a
+// *yaml.TypeError, the config is partially decoded and still returned.
+func readConfigFile(configPath string, strict bool) (*serverYAMLConf, string, error) {
+	configPaths := []string{configPath}
+	if configPath == "" {
+		configPaths = defaultConfigPaths()
+	}
+
+	var (
+		configFile *os.File
+		err        error
+	)
+	for _, configPath = range configPaths {
+		configFile, err = os.Open(configPath)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot find any config file in %v", configPaths)
+	}
+	defer configFile.Close()
+
+	rawConfig := new(serverYAMLConf)
+	decoder := yaml.NewDecoder(configFile)
+	decoder.KnownFields(strict)
+	err = decoder.Decode(rawConfig)
+	if errors.Is(err, io.EOF) {
+		return nil, configPath, fmt.Errorf("%v is empty", configPath)
+	}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		return rawConfig, configPath, err
+	}
+	if err != nil {
+		return nil, configPath, errors.Wrapf(err, "failed to parse %v", configPath)
+	}
+
+	return rawConfig, configPath, nil
+}
+
+// toConfig checks the whole configuration and builds it, without opening
+// the databases. Every problem found is returned.
+func (c *serverYAMLConf) toConfig() (*Config, []error) {
+	conf := &Config{
+		Caches:        make([]*archive.Archive, 0, len(c.Archives)),
+		Schedules:     make(map[string]*refreshSchedule, len(c.Archives)),
+		InsertOptions: make(map[string]database.InsertOptions, len(c.Archives)),
+	}
+	errs := make([]error, 0)
+	// the packages don't record their archive, the archives sharing a
+	// database would overwrite and delete each other's
+	databases := make(map[string]string, len(c.Archives))
+
+	if c.CacheDirectory == "" {
+		errs = append(errs, errors.New("cache_directory is required"))
+	} else if info, err := os.Stat(c.CacheDirectory); err == nil && !info.IsDir() {
+		// it's created on startup if it doesn't exist
+		errs = append(errs, fmt.Errorf("cache_directory %v is not a directory", c.CacheDirectory))
+	}
+
+	if c.Admin.Token != nil {
+		var err error
+		conf.AdminToken, err = c.Admin.Token.read()
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "failed to read admin token"))
+		}
+	}
+
+	if len(c.Archives) == 0 {
+		errs = append(errs, errors.New("no archive defined"))
+	}
+
+	for i, archiveConf := range c.Archives {
+		label := fmt.Sprint(i)
+		if archiveConf.Name != "" {
+			label = archiveConf.Name
+		}
+
+		cache, schedule, archiveErrs := archiveConf.toArchive(c.CacheDirectory)
+		for _, err := range archiveErrs {
+			errs = append(errs, errors.Wrapf(err, "archive %v", label))
+		}
+		if len(archiveErrs) != 0 {
+			continue
+		}
+
+		if _, ok := conf.Schedules[cache.Name]; ok {
+			errs = append(errs, fmt.Errorf("archive %v is defined twice", cache.Name))
+			continue
+		}
+		if other, ok := databases[cache.DBPath]; ok {
+			errs = append(errs, fmt.Errorf("archive %v: database %v is already used by archive %v",
+				cache.Name, database.Redact(cache.DBPath), other))
+			continue
+		}
+		if cache.DBPath != database.MemoryDataSource {
+			databases[cache.DBPath] = cache.Name
+		}
+		conf.Caches = append(conf.Caches, cache)
+		conf.Schedules[cache.Name] = schedule
+		conf.InsertOptions[cache.Name] = archiveConf.Import.toInsertOptions()
+	}
+
+	return conf, errs
+}
+
+// toArchive builds the archive described by the config, without opening
+// its database. Every problem found is returned.
+func (c *archiveYAMLConf) toArchive(cacheDir string) (*archive.Archive, *refreshSchedule, []error) {
+	errs := make([]error, 0)
+
+	if c.BaseURL == "" {
+		errs = append(errs, errors.New("missing base_url"))
+	}
+	baseURL, err := url.Parse(c.BaseURL)
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid base_url"))
+	}
+
+	portsURL := baseURL
+	if c.PortsURL == "" {
+		if len(c.ArchitectureURLs) == 0 {
+			log.Infof("missing ports_url for archive %v, using base url", c.BaseURL)
+		}
+	} else {
+		if len(c.ArchitectureURLs) != 0 {
+			log.Warnf("architecture_urls is set for archive %v, ignoring ports_url", c.BaseURL)
+		}
+		portsURL, err = url.Parse(c.PortsURL)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "invalid ports_url"))
+		}
+	}
+
+	var mirrors *archive.Mirrors
+	if len(c.Mirrors) != 0 {
+		mirrorURLs := make([]*url.URL, 0, len(c.Mirrors)+1)
+		for _, rawURL := range c.Mirrors {
+			mirrorURL, err := url.Parse(rawURL)
+			if err != nil {
+				errs = append(errs, errors.Wrap(err, "invalid mirror URL"))
+				continue
+			}
+			mirrorURLs = append(mirrorURLs, mirrorURL)
+		}
+		// upstream is the last resort
+		mirrors = archive.NewMirrors(append(mirrorURLs, baseURL))
+	}
+
+	var archURLs map[string]*url.URL
+	if len(c.ArchitectureURLs) != 0 {
+		archURLs = make(map[string]*url.URL, len(c.ArchitectureURLs))
+		for arch, rawURL := range c.ArchitectureURLs {
+			archURLs[arch], err = url.Parse(rawURL)
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "invalid URL for architecture %v", arch))
+			}
+		}
+	}
+
+	var discovery *archive.Discovery
+	if c.Discover != nil {
+		if len(c.Pockets) != 0 {
+			log.Warnf("pockets are discovered for archive %v, ignoring the list of pockets", c.BaseURL)
+		}
+
+		discovery = &archive.Discovery{
+			Codenames: c.Discover.Codenames,
+			Suffixes:  c.Discover.Suffixes,
+			Pockets:   c.Discover.toFilter(),
+		}
+		if err := discovery.Pockets.Validate(); err != nil {
+			errs = append(errs, errors.Wrap(err, "invalid discovery filter"))
+		}
+	} else if len(c.Pockets) == 0 {
+		errs = append(errs, errors.New("no pockets and no discovery"))
+	}
+
+	components := c.Components.toFilter()
+	if err := components.Validate(); err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid components filter"))
+	}
+	architectures := c.Architectures.toFilter()
+	if err := architectures.Validate(); err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid architectures filter"))
+	}
+
+	var httpClient *resty.Client
+	auth, err := c.Auth.toAuth()
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid auth"))
+	} else {
+		httpClient, err = archive.NewClient(auth)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "failed to create HTTP client"))
+		}
+	}
+
+	if c.Database == "" {
+		errs = append(errs, errors.New("missing database"))
+	}
+
+	schedule, err := c.Refresh.toSchedule()
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid refresh"))
+	}
+
+	if len(errs) != 0 {
+		return nil, nil, errs
+	}
+
+	name := c.Name
+	if name == "" {
+		name = c.BaseURL
+	}
+
+	return &archive.Archive{
+		Name:             name,
+		BaseURL:          baseURL,
+		PortsURL:         portsURL,
+		ArchitectureURLs: archURLs,
+		Mirrors:          mirrors,
+		Pockets:          c.Pockets,
+		Discovery:        discovery,
+		Components:       components,
+		Architectures:    architectures,
+		CacheDir:         cacheDir,
+		Client:           httpClient,
+		DBPath:           c.Database,
+	}, schedule, nil
+}
+
+// joinErrors merges the problems found in the config in a single error
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// checkConfig strictly validates the config file and prints every
+// problem found. Returns true if the config is valid.
+func checkConfig(configPath string) bool {
+	rawConfig, configPath, err := readConfigFile(configPath, true)
+	if rawConfig == nil {
+		fmt.Println(err)
+		return false
+	}
+
+	errs := make([]error, 0)
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		for _, message := range typeErr.Errors {
+			errs = append(errs, errors.New(message))
+		}
+	}
+
+	_, configErrs := rawConfig.toConfig()
+	errs = append(errs, configErrs...)
+
+	if len(errs) == 0 {
+		fmt.Printf("%v: OK\n", configPath)
+		return true
+	}
+
+	fmt.Printf("%v: %v problems found\n", configPath, len(errs))
+	for _, err := range errs {
+		fmt.Printf("  - %v\n", err)
+	}
+
+	return false
+}
+
+// parseConfig reads the config file and opens the databases of the
+// archives
+func parseConfig(configPath string) (*Config, error) {
+	rawConfig, _, err := readConfigFile(configPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, errs := rawConfig.toConfig()
+	if len(errs) != 0 {
+		return nil, joinErrors(errs)
+	}
+
+	err = os.MkdirAll(rawConfig.CacheDirectory, 0o755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cache directory")
+	}
+
+	for _, cache := range conf.Caches {
+		cache.Database, err = database.Open(cache.DBPath)
+		if err != nil {
+			// don't leak the databases already opened
+			conf.close()
+			return nil, errors.Wrapf(err, "failed to connect to database %v", database.Redact(cache.DBPath))
+		}
+		if db, ok := cache.Database.(*database.DB); ok {
+			db.InsertOptions = conf.InsertOptions[cache.Name]
+		}
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/gjolly/go-rmadison/pkg/database"
+)
+
+// splitFlag returns the comma-separated values of a flag, nil if empty
+func splitFlag(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	values := strings.Split(value, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+
+	return values
+}
+
+// selectArchives returns the archives named, all of them if names is
+// empty
+func selectArchives(caches []*archive.Archive, names []string) ([]*archive.Archive, error) {
+	if len(names) == 0 {
+		return caches, nil
+	}
+
+	byName := make(map[string]*archive.Archive, len(caches))
+	for _, cache := range caches {
+		byName[cache.Name] = cache
+	}
+
+	selected := make([]*archive.Archive, 0, len(names))
+	for _, name := range names {
+		cache, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown archive %v", name)
+		}
+		selected = append(selected, cache)
+	}
+
+	return selected, nil
+}
+
+// exportArchives writes the packages of the archives of the config in a
+// dump. Returns true if everything was exported.
+func exportArchives(opts *options) bool {
+	if opts.exportTo == "" {
+		log.Error("-to is required")
+		return false
+	}
+
+	conf, err := parseConfig(opts.configPath)
+	if err != nil {
+		log.Errorf("failed to read config file: %v", err)
+		return false
+	}
+	defer conf.close()
+
+	caches, err := selectArchives(conf.Caches, splitFlag(opts.archives))
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+
+	var out io.Writer = os.Stdout
+	if opts.exportTo != "-" {
+		file, err := os.Create(opts.exportTo)
+		if err != nil {
+			log.Errorf("failed to create dump: %v", err)
+			return false
+		}
+		defer file.Close()
+		out = file
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	w := database.NewDumpWriter(out)
+	for _, cache := range caches {
+		n, err := database.Export(ctx, w, cache.Name, cache.Database, splitFlag(opts.suites))
+		if err != nil {
+			log.Errorf("failed to export %v: %v", cache.Name, err)
+			return false
+		}
+		// stdout may be the dump
+		fmt.Fprintf(os.Stderr, "%v: %v packages\n", cache.Name, n)
+	}
+
+	err = w.Close()
+	if err != nil {
+		log.Errorf("failed to write dump: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// importDump loads a dump in the databases of the archives of the
+// config. Returns true if everything was imported.
+func importDump(opts *options) bool {
+	conf, err := parseConfig(opts.configPath)
+	if err != nil {
+		log.Errorf("failed to read config file: %v", err)
+		return false
+	}
+	defer conf.close()
+
+	caches, err := selectArchives(conf.Caches, splitFlag(opts.archives))
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	stores := make(map[string]database.Store, len(caches))
+	for _, cache := range caches {
+		stores[cache.Name] = cache.Database
+	}
+
+	var in io.Reader = os.Stdin
+	if opts.importFrom != "-" {
+		file, err := os.Open(opts.importFrom)
+		if err != nil {
+			log.Errorf("failed to open dump: %v", err)
+			return false
+		}
+		defer file.Close()
+		in = file
+	}
+
+	r, err := database.NewDumpReader(in)
+	if err != nil {
+		log.Errorf("failed to read dump: %v", err)
+		return false
+	}
+	defer r.Close()
+
+	// interrupting the import rolls back the running transactions
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	imported, err := database.Import(ctx, r, stores, splitFlag(opts.suites))
+	for _, cache := range caches {
+		fmt.Printf("%v: %v packages\n", cache.Name, imported[cache.Name])
+	}
+	if err != nil {
+		log.Errorf("failed to import dump: %v", err)
+		return false
+	}
+
+	return true
+}
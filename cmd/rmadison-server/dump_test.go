@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+)
+
+func TestSelectArchives(t *testing.T) {
+	caches := []*archive.Archive{{Name: "ubuntu"}, {Name: "esm"}, {Name: "ppa"}}
+
+	selected, err := selectArchives(caches, splitFlag("ppa, ubuntu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Name != "ppa" || selected[1].Name != "ubuntu" {
+		t.Errorf("unexpected archives %+v", selected)
+	}
+
+	selected, err = selectArchives(caches, splitFlag(""))
+	if err != nil || !reflect.DeepEqual(selected, caches) {
+		t.Errorf("expected every archive, got %+v, %v", selected, err)
+	}
+
+	_, err = selectArchives(caches, []string{"debian"})
+	if err == nil {
+		t.Error("expected an error for an unknown archive")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+)
+
+type httpHandler struct {
+	server *server
+}
+
+func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pkg := strings.TrimLeft(r.URL.Path, "/")
+	log.Debugf("lookup for %v", pkg)
+
+	if strings.Contains(pkg, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	allInfo := make([]*debianpkg.PackageInfo, 0)
+	for _, cache := range h.server.Caches() {
+		allInfoArchive, err := cache.Database.GetPackage(r.Context(), pkg)
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		allInfo = append(allInfo, allInfoArchive...)
+	}
+
+	if r.URL.Query().Get("format") == "deb822" {
+		writeStanzas(w, allInfo)
+		return
+	}
+
+	writeJSON(w, allInfo)
+}
+
+// writeStanzas writes the packages like in a Packages file, the
+// location of each package in the archive is added as comments
+func writeStanzas(w http.ResponseWriter, packages []*debianpkg.PackageInfo) {
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	for i, pkg := range packages {
+		if i != 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "# %v%v/%v %v\n", pkg.Suite, pkg.Pocket, pkg.Component, pkg.Architecture)
+		fmt.Fprint(w, pkg.Stanza())
+	}
+}
+
+// provides returns the packages providing the virtual package named
+// after /provides/, in all the archives
+func (h httpHandler) provides(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/provides/")
+	if name == "" || strings.Contains(name, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	providers := make([]*debianpkg.Provider, 0)
+	for _, cache := range h.server.Caches() {
+		archiveProviders, err := cache.Database.GetProviders(r.Context(), name)
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		providers = append(providers, archiveProviders...)
+	}
+
+	writeJSON(w, providers)
+}
+
+// maxSearchResults is the maximum number of package names returned by
+// a search
+const maxSearchResults = 100
+
+// search returns the names of the packages starting with the q
+// parameter, in any archive
+func (h httpHandler) search(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("q")
+	if prefix == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	names := make([]string, 0)
+	for _, cache := range h.server.Caches() {
+		archiveNames, err := cache.Database.SearchPackages(r.Context(), prefix, maxSearchResults)
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		names = append(names, archiveNames...)
+	}
+
+	slices.Sort(names)
+	names = slices.Compact(names)
+	if len(names) > maxSearchResults {
+		names = names[:maxSearchResults]
+	}
+
+	writeJSON(w, names)
+}
+
+type archiveFreshness struct {
+	Archive string                         `json:"archive"`
+	Pockets map[string]archive.PocketState `json:"pockets"`
+}
+
+func (h httpHandler) freshness(w http.ResponseWriter, r *http.Request) {
+	caches := h.server.Caches()
+	freshness := make([]archiveFreshness, len(caches))
+	for i, cache := range caches {
+		freshness[i] = archiveFreshness{
+			Archive: cache.Name,
+			Pockets: cache.PocketStates(),
+		}
+	}
+
+	writeJSON(w, freshness)
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	jsonValue, err := json.Marshal(value)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(jsonValue)
+}
+
+func (h httpHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyz succeeds once all the archives have been refreshed at least once
+func (h httpHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	for _, cache := range h.server.Caches() {
+		if !cache.State().Refreshed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "waiting for %v\n", cache.Name)
+			return
+		}
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+type pocketStatus struct {
+	archive.PocketState
+	Packages int64 `json:"packages"`
+}
+
+type archiveStatus struct {
+	archive.ArchiveState
+	Archive string                  `json:"archive"`
+	Pockets map[string]pocketStatus `json:"pockets"`
+	// FailedPockets are the pockets that failed during the last refresh
+	FailedPockets []string               `json:"failed_pockets"`
+	LastReport    *archive.RefreshReport `json:"last_report,omitempty"`
+}
+
+func (h httpHandler) status(w http.ResponseWriter, r *http.Request) {
+	caches := h.server.Caches()
+	status := make([]archiveStatus, len(caches))
+	for i, cache := range caches {
+		counts, err := cache.Database.CountPackagesPerPocket(r.Context())
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		status[i] = archiveStatus{
+			ArchiveState:  cache.State(),
+			Archive:       cache.Name,
+			Pockets:       make(map[string]pocketStatus),
+			FailedPockets: []string{},
+			LastReport:    cache.LastReport(),
+		}
+		if status[i].LastReport != nil {
+			status[i].FailedPockets = status[i].LastReport.FailedPockets()
+		}
+		for pocket, state := range cache.PocketStates() {
+			status[i].Pockets[pocket] = pocketStatus{
+				PocketState: state,
+				Packages:    counts[pocket],
+			}
+		}
+	}
+
+	writeJSON(w, status)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/gjolly/go-rmadison/pkg/database"
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+)
+
+func newTestHandler(t *testing.T, packages ...[]*debianpkg.PackageInfo) httpHandler {
+	s := new(server)
+	for i, archivePackages := range packages {
+		db := database.NewMemory()
+		writer, err := db.Begin(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pkg := range archivePackages {
+			err = writer.InsertPackage(context.Background(), pkg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = writer.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.caches = append(s.caches, &archive.Archive{Name: string(rune('a' + i)), Database: db})
+	}
+
+	return httpHandler{server: s}
+}
+
+func TestHandlerLookup(t *testing.T) {
+	handler := newTestHandler(t,
+		[]*debianpkg.PackageInfo{{Name: "hello", Version: "2.10-3", Suite: "noble", Architecture: "amd64"}},
+		[]*debianpkg.PackageInfo{{Name: "hello", Version: "2.10-2", Suite: "jammy", Architecture: "amd64"}},
+	)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hello", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %v", w.Code)
+	}
+
+	var packages []debianpkg.PackageInfo
+	err := json.Unmarshal(w.Body.Bytes(), &packages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 2 || packages[0].Suite != "noble" || packages[1].Suite != "jammy" {
+		t.Errorf("unexpected packages: %+v", packages)
+	}
+}
+
+func TestHandlerSearch(t *testing.T) {
+	handler := newTestHandler(t,
+		[]*debianpkg.PackageInfo{
+			{Name: "libc6", Suite: "noble", Architecture: "amd64"},
+			{Name: "libcurl4", Suite: "noble", Architecture: "amd64"},
+		},
+		[]*debianpkg.PackageInfo{
+			{Name: "libc6", Suite: "jammy", Architecture: "amd64"},
+			{Name: "libc-bin", Suite: "jammy", Architecture: "amd64"},
+		},
+	)
+
+	w := httptest.NewRecorder()
+	handler.search(w, httptest.NewRequest(http.MethodGet, "/search?q=libc", nil))
+
+	var names []string
+	err := json.Unmarshal(w.Body.Bytes(), &names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"libc-bin", "libc6", "libcurl4"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	w = httptest.NewRecorder()
+	handler.search(w, httptest.NewRequest(http.MethodGet, "/search", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad request without q, got %v", w.Code)
+	}
+}
+
+func TestHandlerLookupStanza(t *testing.T) {
+	handler := newTestHandler(t, []*debianpkg.PackageInfo{
+		{Name: "hello", Version: "2.10-3", Component: "main", Suite: "noble", Architecture: "amd64", Extra: map[string]string{"Origin": "Ubuntu"}},
+		{Name: "hello", Version: "2.10-3ubuntu1", Component: "main", Suite: "noble", Pocket: "-updates", Architecture: "amd64"},
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hello?format=deb822", nil))
+
+	expected := `# noble/main amd64
+Package: hello
+Architecture: amd64
+Version: 2.10-3
+Origin: Ubuntu
+
+# noble-updates/main amd64
+Package: hello
+Architecture: amd64
+Version: 2.10-3ubuntu1
+`
+	if w.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, w.Body.String())
+	}
+}
+
+func TestHandlerProvides(t *testing.T) {
+	handler := newTestHandler(t,
+		[]*debianpkg.PackageInfo{{Name: "postfix", Suite: "noble", Architecture: "amd64", Provides: []string{"mail-transport-agent"}}},
+		[]*debianpkg.PackageInfo{{Name: "exim4-daemon-light", Suite: "jammy", Architecture: "amd64", Provides: []string{"mail-transport-agent"}}},
+	)
+
+	w := httptest.NewRecorder()
+	handler.provides(w, httptest.NewRequest(http.MethodGet, "/provides/mail-transport-agent", nil))
+
+	var providers []debianpkg.Provider
+	err := json.Unmarshal(w.Body.Bytes(), &providers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 2 || providers[0].Name != "postfix" || providers[1].Name != "exim4-daemon-light" {
+		t.Errorf("unexpected providers: %+v", providers)
+	}
+
+	w = httptest.NewRecorder()
+	handler.provides(w, httptest.NewRequest(http.MethodGet, "/provides/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected not found without a name, got %v", w.Code)
+	}
+}
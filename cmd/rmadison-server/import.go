@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+)
+
+// importArchives refreshes the archives of the config once, all of
+// them unless -archive or -suite is set, and prints a summary. Returns
+// true if everything was imported.
+func importArchives(opts *options) bool {
+	conf, err := parseConfig(opts.configPath)
+	if err != nil {
+		log.Errorf("failed to read config file: %v", err)
+		return false
+	}
+	defer conf.close()
+
+	caches, err := selectArchives(conf.Caches, splitFlag(opts.archives))
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	refreshOpts := archive.RefreshOptions{Local: opts.local, Suites: splitFlag(opts.suites)}
+
+	// interrupting the import rolls back the running transactions
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	reports := make([]*archive.RefreshReport, len(caches))
+	wg := new(sync.WaitGroup)
+	for i, cache := range caches {
+		wg.Add(1)
+		go func(i int, cache *archive.Archive) {
+			defer wg.Done()
+			reports[i], _ = refreshCache(ctx, cache, refreshOpts)
+		}(i, cache)
+	}
+	wg.Wait()
+
+	return printImportSummary(os.Stdout, caches, reports)
+}
+
+// printImportSummary writes the result of the import of each archive,
+// returns true if they all succeeded
+func printImportSummary(w io.Writer, caches []*archive.Archive, reports []*archive.RefreshReport) bool {
+	ok := true
+	for i, cache := range caches {
+		report := reports[i]
+		err := report.Err()
+
+		status := "OK"
+		if err != nil {
+			status = "FAILED"
+			ok = false
+		}
+		fmt.Fprintf(w, "%v: %v, %v files, %v packages in %v\n", cache.Name, status,
+			report.Files(), report.Packages(), report.Finished.Sub(report.Started).Round(time.Millisecond))
+
+		if report.Error != "" {
+			fmt.Fprintf(w, "  - %v\n", report.Error)
+		}
+		for _, pocket := range report.FailedPockets() {
+			fmt.Fprintf(w, "  - %v: %v\n", pocket, report.Pockets[pocket].Err())
+		}
+	}
+
+	return ok
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+)
+
+func TestPrintImportSummary(t *testing.T) {
+	caches := []*archive.Archive{{Name: "ubuntu"}, {Name: "esm"}}
+	reports := []*archive.RefreshReport{
+		{Pockets: map[string]*archive.PocketReport{
+			"noble": {Packages: 2, Indexes: map[string]*archive.IndexReport{"main/binary-amd64/Packages.gz": {Packages: 2}}},
+		}},
+		{Pockets: map[string]*archive.PocketReport{
+			"noble-apps-security": {Error: "Release file is not fresh"},
+		}},
+	}
+
+	out := new(bytes.Buffer)
+	if printImportSummary(out, caches, reports) {
+		t.Error("expected the import to be reported as failed")
+	}
+
+	expected := []string{
+		"ubuntu: OK, 1 files, 2 packages in 0s",
+		"esm: FAILED, 0 files, 0 packages in 0s",
+		"  - noble-apps-security: Release file is not fresh",
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected summary:\n%v", out.String())
+	}
+
+	if !printImportSummary(out, caches[:1], reports[:1]) {
+		t.Error("expected the import to succeed")
+	}
+}
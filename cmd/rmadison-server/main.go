@@ -1,89 +1,107 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"net/http/pprof"
-	"net/url"
 	"os"
-	"path"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gjolly/go-rmadison/pkg/archive"
 	"github.com/gjolly/go-rmadison/pkg/database"
-	"github.com/gjolly/go-rmadison/pkg/debianpkg"
-	"github.com/go-resty/resty/v2"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var log *zap.SugaredLogger
+var (
+	log *zap.SugaredLogger
+	// logLevel is set from the command line once the flags are parsed
+	logLevel = zap.NewAtomicLevelAt(zap.DebugLevel)
+)
+
+// shutdownTimeout is how long the running requests have to finish on
+// shutdown
+const shutdownTimeout = 30 * time.Second
 
 func init() {
 	// Logger for the operations
-	logger, _ := zap.NewDevelopment()
+	config := zap.NewDevelopmentConfig()
+	config.Level = logLevel
+	logger, _ := config.Build()
 	log = logger.Sugar()
+	archive.SetLogger(log)
+	database.SetLogger(log)
 }
 
-type httpHandler struct {
-	Caches []*archive.Archive
+// options are set from the command line, or from the environment
+type options struct {
+	configPath string
+	listenAddr string
+	pprof      bool
+	pprofAddr  string
+	logLevel   string
+	// local imports from the cache when the files are there
+	local bool
+	// exportTo and importFrom are the dumps written and loaded
+	exportTo   string
+	importFrom string
+	// archives and suites are the comma-separated archives and suites
+	// exported, imported or loaded, all of them if empty
+	archives string
+	suites   string
 }
 
-func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	pkg := strings.TrimLeft(r.URL.Path, "/")
-	log.Debugf("lookup for %v", pkg)
-
-	if strings.Contains(pkg, "/") {
-		w.WriteHeader(http.StatusNotFound)
-		return
+// envOr returns the value of the environment variable name, def if unset
+func envOr(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
 	}
 
-	allInfo := make([]*debianpkg.PackageInfo, 0)
-	for _, cache := range h.Caches {
-		allInfoArchive, err := cache.Database.GetPackage(pkg)
-		if err != nil {
-			log.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		allInfo = append(allInfo, allInfoArchive...)
-	}
+	return def
+}
 
-	jsonInfo, err := json.Marshal(allInfo)
+func parseFlags() (*options, string, error) {
+	opts := new(options)
+
+	pprofEnabled, err := strconv.ParseBool(envOr("RMADISON_PPROF", "false"))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, "", errors.Wrap(err, "invalid RMADISON_PPROF")
+	}
+
+	flag.StringVar(&opts.configPath, "config", envOr("RMADISON_CONFIG", ""), "path of the config file, searched in the default locations if empty (env: RMADISON_CONFIG)")
+	flag.StringVar(&opts.listenAddr, "listen", envOr("RMADISON_LISTEN", ":8433"), "address of the HTTP server (env: RMADISON_LISTEN)")
+	flag.BoolVar(&opts.pprof, "pprof", pprofEnabled, "start the pprof server (env: RMADISON_PPROF)")
+	flag.StringVar(&opts.pprofAddr, "pprof-listen", envOr("RMADISON_PPROF_LISTEN", ":8434"), "address of the pprof server (env: RMADISON_PPROF_LISTEN)")
+	flag.BoolVar(&opts.local, "local", false, "import: use the files in the cache instead of downloading them when possible")
+	flag.StringVar(&opts.exportTo, "to", "", "export: file the dump is written to, - for stdout")
+	flag.StringVar(&opts.importFrom, "from", "", "import: load the packages from a dump instead of the archives, - for stdin")
+	flag.StringVar(&opts.archives, "archive", "", "export, import: comma-separated archives, all of them if empty")
+	flag.StringVar(&opts.suites, "suite", "", "export, import: comma-separated suites (eg. noble), all of them if empty")
+	flag.StringVar(&opts.logLevel, "log-level", envOr("RMADISON_LOG_LEVEL", "debug"), "debug, info, warn or error (env: RMADISON_LOG_LEVEL)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] [check-config|import|export]\n", os.Args[0])
+		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(jsonInfo)
-}
-
-func refreshCaches(archives []*archive.Archive) {
-	for _, cache := range archives {
-		go func(cache *archive.Archive) {
-			t := time.NewTicker(5 * time.Minute)
-			for {
-				now := time.Now()
-				_, pkgStats, err := cache.RefreshCache(false)
-				duration := time.Now().Sub(now)
-				if err != nil {
-					log.Errorf("cache refreshed in %v (with error %v), %v packages updated", duration.Seconds(), err, pkgStats)
-				} else {
-					log.Infof("cache refreshed in %v, %v packages updated", duration.Seconds(), pkgStats)
-				}
-
-				<-t.C
-			}
-		}(cache)
+	// the flags can also follow the subcommand
+	command := flag.Arg(0)
+	if command != "" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if flag.NArg() != 0 {
+			return nil, "", fmt.Errorf("unexpected arguments %v", flag.Args())
+		}
 	}
+
+	return opts, command, nil
 }
 
 func startPprofServer(addr string) {
@@ -103,120 +121,115 @@ func startPprofServer(addr string) {
 	log.Fatal(s.ListenAndServe())
 }
 
-// Config is the configuration of the rmadison server
-type Config struct {
-	Caches []*archive.Archive
-}
-
-type archiveYAMLConf struct {
-	BaseURL  string   `yaml:"base_url"`
-	PortsURL string   `yaml:"ports_url"`
-	Database string   `yaml:"database"`
-	Pockets  []string `yaml:"pockets"`
-}
-
-func parseConfig() (*Config, error) {
-	configPaths := []string{
-		"server.yaml",
-		"/etc/rmadison/server",
-	}
-	userConfigDir, err := os.UserConfigDir()
-	if err == nil {
-		configPaths = append(configPaths, path.Join(userConfigDir, "rmadison", "server.yaml"))
-	}
-
-	var configFile *os.File
-	for _, configPath := range configPaths {
-		configFile, err = os.Open(configPath)
-		if err == nil {
-			break
-		}
-	}
+func main() {
+	opts, command, err := parseFlags()
 	if err != nil {
-		return nil, fmt.Errorf("cannot find any config file in %v", configPaths)
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	configBytes, err := io.ReadAll(configFile)
+	err = logLevel.UnmarshalText([]byte(opts.logLevel))
 	if err != nil {
-		return nil, err
+		log.Fatalf("invalid log level: %v", err)
 	}
-	rawConfig := new(struct {
-		CacheDirectory string             `yaml:"cache_directory"`
-		Archives       []*archiveYAMLConf `yaml:"archives"`
-	})
-	yaml.Unmarshal(configBytes, rawConfig)
-	conf := new(Config)
-	conf.Caches = make([]*archive.Archive, len(rawConfig.Archives))
-
-	httpClient := resty.New()
-
-	for i, archiveConf := range rawConfig.Archives {
-		if archiveConf.BaseURL == "" {
-			return nil, fmt.Errorf("missing base_url for archive %v", i)
-		}
 
-		baseURL, err := url.Parse(archiveConf.BaseURL)
-		if err != nil {
-			return nil, err
+	switch command {
+	case "":
+		serve(opts)
+	case "check-config":
+		if !checkConfig(opts.configPath) {
+			os.Exit(1)
 		}
-
-		if archiveConf.PortsURL == "" {
-			log.Infof("missing ports_url for archive %v, using base url", i)
-			archiveConf.PortsURL = archiveConf.BaseURL
+	case "import":
+		var imported bool
+		if opts.importFrom != "" {
+			imported = importDump(opts)
+		} else {
+			imported = importArchives(opts)
 		}
-
-		portsURL, err := url.Parse(archiveConf.PortsURL)
-		if err != nil {
-			return nil, err
+		if !imported {
+			os.Exit(1)
 		}
-		db, err := database.NewConn("sqlite3", archiveConf.Database)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to connect to database %v", archiveConf.Database)
-		}
-		conf.Caches[i] = &archive.Archive{
-			BaseURL:  baseURL,
-			PortsURL: portsURL,
-			Pockets:  archiveConf.Pockets,
-			CacheDir: rawConfig.CacheDirectory,
-			Client:   httpClient,
-			Database: db,
+	case "export":
+		if !exportArchives(opts) {
+			os.Exit(1)
 		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %v\n", command)
+		flag.Usage()
+		os.Exit(2)
 	}
-
-	return conf, err
 }
 
-func main() {
-	go startPprofServer(":8434")
-
-	flag.Parse()
-	cacheDir := flag.Arg(0)
-	if cacheDir == "" {
-		cacheDir, _ = os.MkdirTemp("", "gormadisontest")
+func serve(opts *options) {
+	if opts.pprof {
+		go startPprofServer(opts.pprofAddr)
 	}
 
-	conf, err := parseConfig()
+	conf, err := parseConfig(opts.configPath)
 	if err != nil {
 		log.Fatalf("failed to read config file: %v", err)
 	}
 
-	if len(conf.Caches) == 0 {
-		log.Fatal("No archive defined in config file")
-	}
-
-	refreshCaches(conf.Caches)
+	srv := newServer(conf)
 	handler := httpHandler{
-		Caches: conf.Caches,
-	}
+		server: srv,
+	}
+	admin := newAdminHandler(srv)
+	mux := http.NewServeMux()
+	mux.Handle("/", instrumentHandler("package", handler))
+	mux.Handle("/provides/", instrumentHandler("provides", http.HandlerFunc(handler.provides)))
+	mux.Handle("/search", instrumentHandler("search", http.HandlerFunc(handler.search)))
+	mux.Handle("/freshness", instrumentHandler("freshness", http.HandlerFunc(handler.freshness)))
+	mux.Handle("/metrics", instrumentHandler("metrics", newMetricsHandler(srv)))
+	mux.Handle("/healthz", instrumentHandler("healthz", http.HandlerFunc(handler.healthz)))
+	mux.Handle("/readyz", instrumentHandler("readyz", http.HandlerFunc(handler.readyz)))
+	mux.Handle("/status", instrumentHandler("status", http.HandlerFunc(handler.status)))
+	mux.Handle("/admin/", instrumentHandler("admin", admin))
 
-	addr := ":8433"
 	s := &http.Server{
-		Addr:           addr,
-		Handler:        handler,
+		Addr:           opts.listenAddr,
+		Handler:        mux,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	log.Infof("starting http server on %v\n", addr)
-	log.Fatal(s.ListenAndServe())
+	go func() {
+		log.Infof("starting http server on %v\n", opts.listenAddr)
+		err := s.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Infof("received %v, shutting down", sig)
+			break
+		}
+
+		log.Info("reloading config file")
+		conf, err := parseConfig(opts.configPath)
+		if err != nil {
+			log.Errorf("failed to reload config file, keeping the current one: %v", err)
+			continue
+		}
+		srv.reload(conf)
+	}
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != nil {
+		log.Errorf("failed to drain http server: %v", err)
+	}
+
+	admin.stop()
+	srv.stop()
+	log.Info("stopped")
+	log.Sync()
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmadison_http_requests_total",
+		Help: "Number of HTTP requests by endpoint and status code.",
+	}, []string{"endpoint", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rmadison_http_request_duration_seconds",
+		Help:    "Duration of the HTTP requests by endpoint.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	refreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmadison_refreshes_total",
+		Help: "Number of archive refreshes by result (success, partial or failure).",
+	}, []string{"archive", "result"})
+	refreshDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rmadison_refresh_duration_seconds",
+		Help:    "Duration of the archive refreshes.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"archive"})
+	indexFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmadison_index_failures_total",
+		Help: "Number of package indexes that failed to be downloaded or parsed.",
+	}, []string{"archive", "pocket"})
+)
+
+// instrumentHandler records the requests count and latency of an endpoint
+func instrumentHandler(endpoint string, handler http.Handler) http.Handler {
+	labels := prometheus.Labels{"endpoint": endpoint}
+
+	return promhttp.InstrumentHandlerDuration(
+		httpRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels), handler),
+	)
+}
+
+// recordRefresh records the result of an archive refresh
+func recordRefresh(cache *archive.Archive, report *archive.RefreshReport) {
+	refreshDuration.WithLabelValues(cache.Name).Observe(report.Finished.Sub(report.Started).Seconds())
+
+	result := "success"
+	if report.Error != "" {
+		result = "failure"
+	} else if len(report.FailedPockets()) != 0 {
+		result = "partial"
+	}
+	refreshes.WithLabelValues(cache.Name, result).Inc()
+
+	for pocket, pocketReport := range report.Pockets {
+		for _, index := range pocketReport.Indexes {
+			if index.Error != "" {
+				indexFailures.WithLabelValues(cache.Name, pocket).Inc()
+			}
+		}
+	}
+}
+
+// archiveCollector exports the state of the archives when scraped
+type archiveCollector struct {
+	server *server
+}
+
+var (
+	downloadedBytesDesc = prometheus.NewDesc(
+		"rmadison_downloaded_bytes_total",
+		"Bytes downloaded from the archive.",
+		[]string{"archive"}, nil)
+	importedPackagesDesc = prometheus.NewDesc(
+		"rmadison_imported_packages_total",
+		"Packages imported in the database.",
+		[]string{"archive", "pocket"}, nil)
+	pocketFailuresDesc = prometheus.NewDesc(
+		"rmadison_pocket_refresh_failures_total",
+		"Failed refreshes of a pocket.",
+		[]string{"archive", "pocket"}, nil)
+	pocketRefreshDurationDesc = prometheus.NewDesc(
+		"rmadison_pocket_refresh_duration_seconds",
+		"Duration of the last import of a pocket.",
+		[]string{"archive", "pocket"}, nil)
+	sinceLastRefreshDesc = prometheus.NewDesc(
+		"rmadison_pocket_seconds_since_last_refresh",
+		"Time since the last successful refresh of a pocket.",
+		[]string{"archive", "pocket"}, nil)
+	databaseSizeDesc = prometheus.NewDesc(
+		"rmadison_database_size_bytes",
+		"Size of the database of the archive.",
+		[]string{"archive"}, nil)
+	failedPocketsDesc = prometheus.NewDesc(
+		"rmadison_last_refresh_failed_pockets",
+		"Pockets that failed during the last refresh.",
+		[]string{"archive"}, nil)
+	databaseRowsDesc = prometheus.NewDesc(
+		"rmadison_database_rows",
+		"Number of rows in the database tables.",
+		[]string{"archive", "table"}, nil)
+)
+
+func (c archiveCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- downloadedBytesDesc
+	ch <- importedPackagesDesc
+	ch <- pocketFailuresDesc
+	ch <- pocketRefreshDurationDesc
+	ch <- sinceLastRefreshDesc
+	ch <- failedPocketsDesc
+	ch <- databaseSizeDesc
+	ch <- databaseRowsDesc
+}
+
+func (c archiveCollector) Collect(ch chan<- prometheus.Metric) {
+	// the registry doesn't pass the context of the scrape
+	ctx := context.Background()
+	now := time.Now()
+
+	for _, cache := range c.server.Caches() {
+		ch <- prometheus.MustNewConstMetric(downloadedBytesDesc, prometheus.CounterValue, float64(cache.DownloadedBytes()), cache.Name)
+
+		for pocket, state := range cache.PocketStates() {
+			ch <- prometheus.MustNewConstMetric(importedPackagesDesc, prometheus.CounterValue, float64(state.ImportedPackages), cache.Name, pocket)
+			ch <- prometheus.MustNewConstMetric(pocketFailuresDesc, prometheus.CounterValue, float64(state.Failures), cache.Name, pocket)
+			ch <- prometheus.MustNewConstMetric(pocketRefreshDurationDesc, prometheus.GaugeValue, state.RefreshDuration.Seconds(), cache.Name, pocket)
+			if !state.LastRefresh.IsZero() {
+				ch <- prometheus.MustNewConstMetric(sinceLastRefreshDesc, prometheus.GaugeValue, now.Sub(state.LastRefresh).Seconds(), cache.Name, pocket)
+			}
+		}
+
+		if report := cache.LastReport(); report != nil {
+			ch <- prometheus.MustNewConstMetric(failedPocketsDesc, prometheus.GaugeValue, float64(len(report.FailedPockets())), cache.Name)
+		}
+
+		size, err := cache.Database.Size(ctx)
+		if err != nil {
+			log.Errorf("failed to get size of database for %v: %v", cache.Name, err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(databaseSizeDesc, prometheus.GaugeValue, float64(size), cache.Name)
+		}
+
+		counts, err := cache.Database.RowCounts(ctx)
+		if err != nil {
+			log.Errorf("failed to count rows in database for %v: %v", cache.Name, err)
+			continue
+		}
+		for table, n := range counts {
+			ch <- prometheus.MustNewConstMetric(databaseRowsDesc, prometheus.GaugeValue, float64(n), cache.Name, table)
+		}
+	}
+}
+
+// newMetricsHandler registers the metrics and returns the handler
+// serving them
+func newMetricsHandler(s *server) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		refreshes,
+		refreshDuration,
+		indexFailures,
+		archiveCollector{s},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	defaultRefreshInterval = 5 * time.Minute
+	defaultMaxBackoff      = time.Hour
+)
+
+// refreshSchedule decides when an archive is refreshed
+type refreshSchedule struct {
+	// Interval between the start of two refreshes
+	Interval time.Duration
+	// Cron, if not nil, is used instead of Interval
+	Cron cron.Schedule
+	// MaxBackoff caps the delay between retries after failures
+	MaxBackoff time.Duration
+	// Jitter is the maximum random delay added to each wait
+	Jitter time.Duration
+	// Timeout, if not zero, cancels the refreshes taking longer
+	Timeout time.Duration
+}
+
+// next returns when the next refresh should start given the start of the
+// last refresh and the number of consecutive failures
+func (s *refreshSchedule) next(lastStart time.Time, failures int) time.Time {
+	now := time.Now()
+
+	var next time.Time
+	switch {
+	case failures > 0:
+		// exponential backoff, starting at the normal interval
+		backoff := s.Interval
+		if s.Cron != nil {
+			backoff = defaultRefreshInterval
+		}
+		for i := 1; i < failures && backoff < s.MaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+		next = now.Add(backoff)
+	case s.Cron != nil:
+		next = s.Cron.Next(now)
+	default:
+		next = lastStart.Add(s.Interval)
+	}
+
+	if s.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+
+	return next
+}
+
+func refreshCache(ctx context.Context, cache *archive.Archive, opts archive.RefreshOptions) (*archive.RefreshReport, error) {
+	report, err := cache.RefreshCache(ctx, opts)
+	duration := report.Finished.Sub(report.Started)
+	recordRefresh(cache, report)
+	if err != nil {
+		log.Errorf("[%v] cache refreshed in %v (with error %v), %v packages updated", cache.Name, duration.Seconds(), err, report.Packages())
+	} else {
+		log.Infof("[%v] cache refreshed in %v, %v packages updated", cache.Name, duration.Seconds(), report.Packages())
+	}
+
+	return report, err
+}
+
+// refresher refreshes an archive on its schedule until stopped
+type refresher struct {
+	schedule *refreshSchedule
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func startRefresher(cache *archive.Archive, schedule *refreshSchedule) *refresher {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &refresher{
+		schedule: schedule,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+
+		failures := 0
+		for ctx.Err() == nil {
+			start := time.Now()
+			// stopping the refresher interrupts the running refresh, the
+			// packages are committed in batches so nothing is half written
+			refreshCtx, cancelRefresh := ctx, func() {}
+			if schedule.Timeout > 0 {
+				refreshCtx, cancelRefresh = context.WithTimeout(refreshCtx, schedule.Timeout)
+			}
+			_, err := refreshCache(refreshCtx, cache, archive.RefreshOptions{})
+			cancelRefresh()
+			if err != nil {
+				failures++
+			} else {
+				failures = 0
+			}
+
+			next := schedule.next(start, failures)
+			log.Debugf("[%v] next refresh at %v", cache.Name, next)
+
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}()
+
+	return r
+}
+
+// stop stops the refresher, interrupting the running refresh if any,
+// and waits for it to return
+func (r *refresher) stop() {
+	r.cancel()
+	<-r.done
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/gjolly/go-rmadison/pkg/database"
+	"github.com/go-resty/resty/v2"
+	"github.com/robfig/cron/v3"
+)
+
+func TestRefreshScheduleNext(t *testing.T) {
+	schedule := &refreshSchedule{
+		Interval:   5 * time.Minute,
+		MaxBackoff: time.Hour,
+	}
+
+	start := time.Now()
+	if next := schedule.next(start, 0); !next.Equal(start.Add(5 * time.Minute)) {
+		t.Errorf("expected next refresh 5 minutes after the start, got %v", next.Sub(start))
+	}
+
+	expectedBackoffs := map[int]time.Duration{
+		1:  5 * time.Minute,
+		2:  10 * time.Minute,
+		3:  20 * time.Minute,
+		4:  40 * time.Minute,
+		5:  time.Hour,
+		50: time.Hour,
+	}
+	for failures, expected := range expectedBackoffs {
+		backoff := time.Until(schedule.next(start, failures))
+		if backoff > expected || backoff < expected-time.Second {
+			t.Errorf("%v failures: expected %v, got %v", failures, expected, backoff)
+		}
+	}
+
+	schedule.Jitter = time.Minute
+	for i := 0; i < 100; i++ {
+		delay := schedule.next(start, 0).Sub(start)
+		if delay < 5*time.Minute || delay >= 6*time.Minute {
+			t.Fatalf("delay out of the jitter range: %v", delay)
+		}
+	}
+}
+
+func TestRefreshScheduleCron(t *testing.T) {
+	cronSchedule, err := cron.ParseStandard("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedule := &refreshSchedule{
+		Interval:   5 * time.Minute,
+		Cron:       cronSchedule,
+		MaxBackoff: time.Hour,
+	}
+
+	next := schedule.next(time.Now(), 0)
+	if next.Minute() != 0 || next.Second() != 0 {
+		t.Errorf("expected a refresh at the start of an hour, got %v", next)
+	}
+	if time.Until(next) > time.Hour {
+		t.Errorf("expected a refresh within the hour, got %v", next)
+	}
+}
+
+func TestRefresherStopInterruptsRefresh(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		// the download hangs until the client gives up
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+	baseURL, err := url.Parse(upstream.URL + "/dists")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &archive.Archive{
+		Name:     "test",
+		BaseURL:  baseURL,
+		PortsURL: baseURL,
+		Pockets:  []string{"noble"},
+		CacheDir: t.TempDir(),
+		Client:   resty.New(),
+		Database: database.NewMemory(),
+	}
+	r := startRefresher(cache, &refreshSchedule{Interval: time.Hour, MaxBackoff: time.Hour})
+
+	select {
+	case <-requested:
+	case <-time.After(10 * time.Second):
+		t.Fatal("refresh not started")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		r.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("stopping the refresher waited for the refresh")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/gjolly/go-rmadison/pkg/archive"
+	"github.com/gjolly/go-rmadison/pkg/database"
+)
+
+// server holds the archives being served, they change when the
+// configuration is reloaded
+type server struct {
+	mutex      sync.RWMutex
+	caches     []*archive.Archive
+	adminToken string
+
+	// refreshers by archive name, only used by reload and stop which
+	// must not be called concurrently
+	refreshers map[string]*refresher
+	// stopping are the refreshers stopped by reload that may still be
+	// returning
+	stopping sync.WaitGroup
+}
+
+func newServer(conf *Config) *server {
+	s := &server{
+		refreshers: make(map[string]*refresher),
+	}
+	s.reload(conf)
+
+	return s
+}
+
+// Caches returns the archives currently served. The slice must not be
+// modified.
+func (s *server) Caches() []*archive.Archive {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.caches
+}
+
+// AdminToken returns the token protecting the admin API, empty if
+// the API is disabled
+func (s *server) AdminToken() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.adminToken
+}
+
+// reload applies a new configuration. The archives that still exist are
+// updated in place so that what was imported is kept, the others are
+// stopped and the new ones started.
+func (s *server) reload(conf *Config) {
+	current := make(map[string]*archive.Archive)
+	for _, cache := range s.Caches() {
+		current[cache.Name] = cache
+	}
+
+	caches := make([]*archive.Archive, 0, len(conf.Caches))
+	started := make([]*archive.Archive, 0)
+	removedPockets := make(map[*archive.Archive][]string)
+	for _, cache := range conf.Caches {
+		existing, ok := current[cache.Name]
+		if !ok || existing.DBPath != cache.DBPath {
+			log.Infof("[%v] adding archive", cache.Name)
+			caches = append(caches, cache)
+			started = append(started, cache)
+			continue
+		}
+
+		// the database of the existing archive is kept
+		delete(current, cache.Name)
+		err := cache.Database.Close()
+		if err != nil {
+			log.Errorf("failed to close database of %v: %v", cache.Name, err)
+		}
+
+		log.Infof("[%v] updating archive", cache.Name)
+		// the running batches read the options, they are not changed in place
+		if db, ok := existing.Database.(*database.DB); ok && db.InsertOptions != conf.InsertOptions[cache.Name] {
+			log.Warnf("[%v] the import options only change on restart", cache.Name)
+		}
+		removed := existing.Update(cache)
+		if len(removed) != 0 {
+			removedPockets[existing] = removed
+		}
+		caches = append(caches, existing)
+
+		// the refresh interrupted by the new refresher is serialized
+		// with its first one by the archive
+		schedule := conf.Schedules[cache.Name]
+		if !reflect.DeepEqual(s.refreshers[cache.Name].schedule, schedule) {
+			s.stopRefresher(s.refreshers[cache.Name], nil)
+			s.refreshers[cache.Name] = startRefresher(existing, schedule)
+		}
+	}
+
+	s.mutex.Lock()
+	s.caches = caches
+	s.adminToken = conf.AdminToken
+	s.mutex.Unlock()
+
+	// what remains is not served anymore
+	for name, cache := range current {
+		log.Infof("[%v] removing archive", name)
+		s.stopRefresher(s.refreshers[name], cache)
+		delete(s.refreshers, name)
+	}
+
+	for cache, pockets := range removedPockets {
+		err := cache.DeletePockets(context.Background(), pockets)
+		if err != nil {
+			log.Errorf("[%v] failed to delete removed pockets: %v", cache.Name, err)
+		}
+	}
+
+	for _, cache := range started {
+		s.refreshers[cache.Name] = startRefresher(cache, conf.Schedules[cache.Name])
+	}
+}
+
+// stopRefresher stops r without waiting for its refresh to return so
+// that reload doesn't block the signals. The database of cache, if not
+// nil, is closed once it has.
+func (s *server) stopRefresher(r *refresher, cache *archive.Archive) {
+	r.cancel()
+
+	s.stopping.Add(1)
+	go func() {
+		defer s.stopping.Done()
+		<-r.done
+		if cache == nil {
+			return
+		}
+		err := cache.Close()
+		if err != nil {
+			log.Errorf("failed to close database of %v: %v", cache.Name, err)
+		}
+	}()
+}
+
+// stop stops refreshing the archives and closes their databases
+func (s *server) stop() {
+	wg := new(sync.WaitGroup)
+	for _, r := range s.refreshers {
+		wg.Add(1)
+		go func(r *refresher) {
+			defer wg.Done()
+			r.stop()
+		}(r)
+	}
+	wg.Wait()
+	s.stopping.Wait()
+	s.refreshers = make(map[string]*refresher)
+
+	for _, cache := range s.Caches() {
+		err := cache.Close()
+		if err != nil {
+			log.Errorf("failed to close database of %v: %v", cache.Name, err)
+		}
+	}
+}
@@ -32,7 +32,9 @@ func sortArch(line []string) {
 func groupByComponent(lines [][]string) [][]string {
 	linesBySeries := make(map[string][]string)
 	for _, line := range lines {
-		key := line[2]
+		// the packages are grouped by name too when listing the
+		// providers of a virtual package
+		key := line[0] + " " + line[2]
 		version := line[1]
 		if newLine, ok := linesBySeries[key]; ok && newLine[1] == version {
 			newLine[3] += ", " + line[3]
@@ -53,20 +55,50 @@ func groupByComponent(lines [][]string) [][]string {
 	return out
 }
 
-func main() {
-	client := resty.New()
+// formatSuite returns the suite, pocket and component like
+// "noble-updates/universe", main being omitted
+func formatSuite(suite, pocket, component string) string {
+	formatedComponent := ""
+	if component != "main" {
+		formatedComponent = "/" + component
+	}
 
-	flag.Parse()
+	return suite + pocket + formatedComponent
+}
 
-	pkg := flag.Arg(0)
+func printLines(lines [][]string) {
+	lines = groupByComponent(lines)
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i][2] != lines[j][2] {
+			return lines[i][2] < lines[j][2]
+		}
+		return lines[i][0] < lines[j][0]
+	})
 
-	baseURL := "https://packages.gauthier.uk"
+	widths := make([]int, 0)
+	for _, line := range lines {
+		for i, word := range line {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if len(word) > widths[i] {
+				widths[i] = len(word)
+			}
+		}
+	}
 
-	queryURL := fmt.Sprintf("%v/%v", baseURL, pkg)
+	for _, line := range lines {
+		columns := make([]string, len(line))
+		for i, word := range line {
+			columns[i] = fmt.Sprintf("%-*v", widths[i], word)
+		}
+		fmt.Println(" " + strings.TrimRight(strings.Join(columns, " | "), " "))
+	}
+}
 
-	var pkgInfo []debianpkg.PackageInfo
+func get(client *resty.Client, queryURL string, result any) {
 	resp, err := client.R().
-		SetResult(&pkgInfo).
+		SetResult(result).
 		Get(queryURL)
 
 	if err != nil {
@@ -75,30 +107,49 @@ func main() {
 	if resp.IsError() {
 		log.Fatal(resp.Status())
 	}
+}
+
+func main() {
+	client := resty.New()
+
+	provides := flag.Bool("provides", false, "list the packages providing a virtual package")
+	flag.Parse()
+
+	pkg := flag.Arg(0)
+
+	baseURL := "https://packages.gauthier.uk"
 
-	widths := make([]int, 4)
 	lines := make([][]string, 0)
-	for _, info := range pkgInfo {
-		formatedComponent := ""
-		if info.Component != "main" {
-			formatedComponent = "/" + info.Component
-		}
-		line := []string{info.Name, info.Version, info.Suite + info.Pocket + formatedComponent, info.Architecture}
-		for i, word := range line {
-			if len(word) > widths[i] {
-				widths[i] = len(word)
+	if *provides {
+		var providers []debianpkg.Provider
+		get(client, fmt.Sprintf("%v/provides/%v", baseURL, pkg), &providers)
+
+		for _, provider := range providers {
+			providedVersion := ""
+			if provider.ProvidedVersion != "" {
+				providedVersion = fmt.Sprintf("provides %v (= %v)", pkg, provider.ProvidedVersion)
 			}
+			lines = append(lines, []string{
+				provider.Name,
+				provider.Version,
+				formatSuite(provider.Suite, provider.Pocket, provider.Component),
+				provider.Architecture,
+				providedVersion,
+			})
+		}
+	} else {
+		var pkgInfo []debianpkg.PackageInfo
+		get(client, fmt.Sprintf("%v/%v", baseURL, pkg), &pkgInfo)
+
+		for _, info := range pkgInfo {
+			lines = append(lines, []string{
+				info.Name,
+				info.Version,
+				formatSuite(info.Suite, info.Pocket, info.Component),
+				info.Architecture,
+			})
 		}
-		lines = append(lines, line)
 	}
 
-	lines = groupByComponent(lines)
-	sort.Slice(lines, func(i, j int) bool {
-		return lines[i][2] < lines[j][2]
-	})
-
-	lineFormat := fmt.Sprintf(" %%-%vv | %%-%vv | %%-%vv | %%-%vv\n", widths[0], widths[1], widths[2], widths[3])
-	for _, line := range lines {
-		fmt.Printf(lineFormat, line[0], line[1], line[2], line[3])
-	}
+	printLines(lines)
 }
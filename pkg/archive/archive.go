@@ -2,16 +2,20 @@ package archive
 
 import (
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gjolly/go-rmadison/pkg/database"
@@ -29,6 +33,11 @@ func init() {
 	log = logger.Sugar()
 }
 
+// SetLogger replaces the logger used by the package
+func SetLogger(logger *zap.SugaredLogger) {
+	log = logger
+}
+
 // ReleaseFileEntry is a entry in a release file
 type ReleaseFileEntry struct {
 	Hash string
@@ -44,23 +53,83 @@ type ReleaseFile struct {
 	Version       string
 	Codename      string
 	Date          time.Time
+	ValidUntil    time.Time
 	Architectures []string
 	Components    []string
 	Description   string
 	PackageIndex  map[string]ReleaseFileEntry
 	Hash          string
+	// Mirror is the base URL the Release file was downloaded from,
+	// nil if it was read from the cache
+	Mirror *url.URL
+
+	// state is saved once the package indexes are imported, nil if the
+	// file wasn't downloaded
+	state *database.ReleaseState
+}
+
+// AnyArchitecture is the key of ArchitectureURLs used for the
+// architectures without their own entry
+const AnyArchitecture = "*"
+
+// UbuntuArchitectureURLs returns the mapping used by the Ubuntu archive:
+// amd64 and i386 are hosted on the main archive, the other architectures
+// on the ports archive
+func UbuntuArchitectureURLs(baseURL, portsURL *url.URL) map[string]*url.URL {
+	return map[string]*url.URL{
+		"amd64":         baseURL,
+		"i386":          baseURL,
+		AnyArchitecture: portsURL,
+	}
 }
 
 // Archive is a debian archive
 type Archive struct {
-	BaseURL     *url.URL
-	PortsURL    *url.URL
+	Name     string
+	BaseURL  *url.URL
+	PortsURL *url.URL
+	// ArchitectureURLs maps architectures to the base URL hosting their
+	// package indexes. If nil, UbuntuArchitectureURLs is used.
+	ArchitectureURLs map[string]*url.URL
+	// Mirrors, if not nil, are the locations tried to download the files
+	// otherwise downloaded from BaseURL
+	Mirrors     *Mirrors
 	Client      *resty.Client
 	ReleaseInfo map[string]*ReleaseFile
 	Pockets     []string
-	CacheDir    string
-	Database    *database.DB
-	DBPath      string
+	Discovery   *Discovery
+	// Components and Architectures select the package indexes to import
+	Components    Filter
+	Architectures Filter
+	CacheDir      string
+	Database      database.Store
+	DBPath        string
+
+	refreshMutex sync.Mutex
+
+	stateMutex sync.RWMutex
+	state      ArchiveState
+	states     map[string]*PocketState
+	lastReport *RefreshReport
+
+	downloadedBytes atomic.Int64
+}
+
+// architectureURL returns the base URL hosting the package indexes for arch
+func (a *Archive) architectureURL(arch string) *url.URL {
+	archURLs := a.ArchitectureURLs
+	if archURLs == nil {
+		archURLs = UbuntuArchitectureURLs(a.BaseURL, a.PortsURL)
+	}
+
+	if archURL, ok := archURLs[arch]; ok && archURL != nil {
+		return archURL
+	}
+	if archURL, ok := archURLs[AnyArchitecture]; ok && archURL != nil {
+		return archURL
+	}
+
+	return a.BaseURL
 }
 
 func (a *Archive) getReleaseFileLocationsForPocket(pocket string) (url.URL, string) {
@@ -73,55 +142,236 @@ func (a *Archive) getReleaseFileLocationsForPocket(pocket string) (url.URL, stri
 	return fileURL, outputFilePath
 }
 
+// RefreshOptions changes how an archive is refreshed
+type RefreshOptions struct {
+	// Local uses the files from the cache directory when they exist
+	Local bool
+	// Force re-imports the package indexes even if they haven't changed
+	Force bool
+	// Pockets restricts the refresh to some pockets, all the pockets
+	// are refreshed if empty
+	Pockets []string
+	// Suites restricts the refresh to the pockets of some suites (eg.
+	// noble for noble, noble-updates...), see database.MatchSuite
+	Suites []string
+}
+
 // GetReleaseInfo downloads all the release files for the pockets and parses them
-func (a *Archive) GetReleaseInfo(local bool) (map[string]*ReleaseFile, error) {
+func (a *Archive) GetReleaseInfo(ctx context.Context, local bool) (map[string]*ReleaseFile, error) {
+	report := newRefreshReport()
+	releaseInfo := a.getReleaseInfo(ctx, a.Pockets, RefreshOptions{Local: local}, report)
+
+	return releaseInfo, report.Err()
+}
+
+func (a *Archive) getReleaseInfo(ctx context.Context, pockets []string, opts RefreshOptions, report *RefreshReport) map[string]*ReleaseFile {
 	releaseInfo := make(map[string]*ReleaseFile)
-	for _, pocket := range a.Pockets {
-		fileURL, outputFilePath := a.getReleaseFileLocationsForPocket(pocket)
+	for _, pocket := range pockets {
+		releaseFile, err := a.getPocketReleaseInfo(ctx, pocket, opts)
+		if err != nil {
+			log.Errorf("[release] %v", err)
+			report.pocket(pocket).Error = err.Error()
+			continue
+		}
+		if releaseFile == nil {
+			report.pocket(pocket).Unchanged = true
+			continue
+		}
 
-		file, err := os.Open(outputFilePath)
-		if err != nil || !local {
-			log.Debugf("[release] fetching %v", outputFilePath)
-			err := downloadFile(a.Client, fileURL, outputFilePath)
-			if err != nil {
-				return nil, err
-			}
+		releaseInfo[pocket] = releaseFile
+	}
 
-			file, err = os.Open(outputFilePath)
+	return releaseInfo
+}
+
+// getPocketReleaseInfo downloads and parses the Release file of a pocket,
+// returns nil if it didn't change since the last refresh
+func (a *Archive) getPocketReleaseInfo(ctx context.Context, pocket string, opts RefreshOptions) (*ReleaseFile, error) {
+	_, outputFilePath := a.getReleaseFileLocationsForPocket(pocket)
+
+	var mirror *url.URL
+	var state *database.ReleaseState
+	file, err := os.Open(outputFilePath)
+	if err != nil || !opts.Local {
+		log.Debugf("[release] fetching %v", outputFilePath)
+		mirror, state, err = a.fetchReleaseFile(ctx, pocket, outputFilePath, !opts.Force)
+		a.setPocketState(pocket, func(state *PocketState) {
+			state.LastChecked = time.Now()
+			state.Rejected = ""
 			if err != nil {
-				return nil, err
+				state.Rejected = err.Error()
 			}
-		} else {
-			log.Debugf("[release] local %v", outputFilePath)
+		})
+		// if the Release file is not fresh, the data we have is kept
+		// rather than rolled back
+		if err != nil {
+			return nil, err
 		}
-		defer file.Close()
 
-		shaSum := sha256.New()
-		if _, err := io.Copy(shaSum, file); err != nil {
-			return nil, fmt.Errorf("failed to compute hash for %v", outputFilePath)
+		file, err = os.Open(outputFilePath)
+		if err != nil {
+			return nil, err
 		}
-		shaSumStr := fmt.Sprintf("%x", shaSum)
+	} else {
+		log.Debugf("[release] local %v", outputFilePath)
+	}
+	defer file.Close()
 
-		// If the index file hasn't changed, let's not re-parse it
-		if releaseFile, ok := a.ReleaseInfo[pocket]; ok && shaSumStr == releaseFile.Hash {
-			log.Debugf("[release] nothing to do %v", outputFilePath)
-			continue
+	shaSum := sha256.New()
+	if _, err := io.Copy(shaSum, file); err != nil {
+		return nil, fmt.Errorf("failed to compute hash for %v", outputFilePath)
+	}
+	shaSumStr := fmt.Sprintf("%x", shaSum)
+
+	// If the index file hasn't changed, let's not re-parse it
+	if releaseFile, ok := a.ReleaseInfo[pocket]; ok && shaSumStr == releaseFile.Hash && !opts.Force {
+		log.Debugf("[release] nothing to do %v", outputFilePath)
+		// it was already imported, only the validators changed
+		a.saveReleaseState(ctx, state)
+		return nil, nil
+	}
+
+	log.Debugf("[release] parsing %v", outputFilePath)
+	releaseFile, err := ParseReleaseFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse Release file (%v)", outputFilePath)
+	}
+	releaseFile.Hash = shaSumStr
+	releaseFile.Mirror = mirror
+	releaseFile.state = state
+
+	return releaseFile, nil
+}
+
+// saveReleaseState saves the state of a Release file, if any, once its
+// package indexes are imported
+func (a *Archive) saveReleaseState(ctx context.Context, state *database.ReleaseState) {
+	if state == nil || a.Database == nil {
+		return
+	}
+
+	err := a.Database.SetReleaseState(ctx, state)
+	if err != nil {
+		log.Warnf("[release] failed to save state of %v: %v", state.Pocket, err)
+	}
+}
+
+// fetchReleaseFile downloads the InRelease file of the pocket from the
+// first mirror serving a Release file at least as recent as the one we
+// already know about. If the file in the cache is still up to date, it is
+// left untouched, unless conditional is false. Returns the base URL of the
+// mirror used and, if the file was downloaded, its state. The state is
+// only saved by the caller once the pocket is imported, so that the
+// validators and the date never describe packages missing from the
+// database.
+func (a *Archive) fetchReleaseFile(ctx context.Context, pocket, outputFilePath string, conditional bool) (*url.URL, *database.ReleaseState, error) {
+	tmpFilePath := outputFilePath + ".part"
+	defer os.Remove(tmpFilePath)
+
+	var state *database.ReleaseState
+	if a.Database != nil {
+		var err error
+		state, err = a.Database.GetReleaseState(ctx, a.Name, pocket)
+		if err != nil {
+			log.Warnf("[release] failed to get state of %v: %v", pocket, err)
 		}
+	}
+	// the validators describe the file in the cache
+	_, err := os.Stat(outputFilePath)
+	useValidators := err == nil && conditional && state != nil
+
+	// the date of the last Release file accepted survives restarts, a
+	// mirror can't roll the pocket back once ReleaseInfo is empty
+	var lastDate time.Time
+	if state != nil {
+		lastDate = state.Date
+	}
 
-		log.Debugf("[release] parsing %v", outputFilePath)
-		releaseInfo[pocket], err = ParseReleaseFile(file)
+	errs := make([]string, 0)
+	notFresh := true
+	for _, baseURL := range a.mirrorURLs(nil) {
+		fileURL := url.URL(*baseURL)
+		fileURL.Path = path.Join(fileURL.Path, pocket, "InRelease")
+
+		// the validators are only meaningful for the server that sent them
+		var etag, lastModified string
+		if useValidators && state.URL == fileURL.String() {
+			etag, lastModified = state.ETag, state.LastModified
+		}
+
+		modified, etag, lastModified, err := a.downloadFileIfModified(ctx, fileURL, tmpFilePath, etag, lastModified)
+		if ctx.Err() != nil {
+			// not the fault of the mirror
+			return nil, nil, ctx.Err()
+		}
+		if err == nil && !modified {
+			log.Debugf("[release] not modified %v", fileURL.String())
+			a.Mirrors.ReportSuccess(baseURL)
+			return baseURL, nil, nil
+		}
+		var releaseFile *ReleaseFile
+		if err == nil {
+			releaseFile, err = a.checkReleaseFreshness(pocket, tmpFilePath, lastDate)
+		}
 		if err != nil {
-			log.Errorf("failed to parse Release file (%v): %v", outputFilePath, err)
+			log.Warnf("[release] rejecting %v: %v", fileURL.String(), err)
+			a.Mirrors.ReportFailure(baseURL)
+			errs = append(errs, err.Error())
+			notFresh = notFresh && errors.Is(err, ErrReleaseNotFresh)
 			continue
 		}
-		releaseInfo[pocket].Hash = shaSumStr
 
+		a.Mirrors.ReportSuccess(baseURL)
+		err = os.Rename(tmpFilePath, outputFilePath)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+
+		return baseURL, &database.ReleaseState{
+			Archive:      a.Name,
+			Pocket:       pocket,
+			URL:          fileURL.String(),
+			ETag:         etag,
+			LastModified: lastModified,
+			Date:         releaseFile.Date,
+		}, nil
+	}
+
+	err = fmt.Errorf("failed to fetch InRelease for %v: %v", pocket, strings.Join(errs, "; "))
+	if notFresh {
+		err = fmt.Errorf("%w: %v", ErrReleaseNotFresh, err)
+	}
+
+	return nil, nil, err
+}
+
+// checkReleaseFreshness makes sure that the Release file isn't expired
+// and isn't older than the one we already have for the pocket, nor than
+// lastDate, the date of the last one accepted if known
+func (a *Archive) checkReleaseFreshness(pocket, filePath string, lastDate time.Time) (*ReleaseFile, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	releaseFile, err := ParseReleaseFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if !releaseFile.ValidUntil.IsZero() && releaseFile.ValidUntil.Before(time.Now()) {
+		return releaseFile, fmt.Errorf("%w: expired on %v", ErrReleaseNotFresh, releaseFile.ValidUntil)
+	}
+
+	if previous, ok := a.ReleaseInfo[pocket]; ok && previous.Date.After(lastDate) {
+		lastDate = previous.Date
+	}
+	if releaseFile.Date.Before(lastDate) {
+		return releaseFile, fmt.Errorf("%w: dated %v, older than %v", ErrReleaseNotFresh, releaseFile.Date, lastDate)
 	}
 
-	return releaseInfo, nil
+	return releaseFile, nil
 }
 
 func parseIndexLine(line string) *ReleaseFileEntry {
@@ -144,6 +394,17 @@ func parseIndexLine(line string) *ReleaseFileEntry {
 	}
 }
 
+// parseReleaseDate parses a date from a Release file, they are usually
+// in UTC (eg. "Thu, 26 Oct 2023 14:32:18 UTC")
+func parseReleaseDate(value string) (time.Time, error) {
+	date, err := time.Parse(time.RFC1123Z, value)
+	if err == nil {
+		return date, nil
+	}
+
+	return time.Parse(time.RFC1123, value)
+}
+
 // ParseReleaseFile parses the content of a release file
 func ParseReleaseFile(file *os.File) (*ReleaseFile, error) {
 	file.Seek(0, 0)
@@ -170,14 +431,14 @@ func ParseReleaseFile(file *os.File) (*ReleaseFile, error) {
 			value := keyValue[1]
 
 			v := reflect.Indirect(reflect.ValueOf(releaseFile))
-			field := v.FieldByName(key)
+			field := v.FieldByName(strings.ReplaceAll(key, "-", ""))
 			if field == (reflect.Value{}) {
 				// we don't know about this field
 				continue
 			}
 
-			if key == "Date" {
-				date, err := time.Parse(time.RFC1123Z, value)
+			if key == "Date" || key == "Valid-Until" {
+				date, err := parseReleaseDate(value)
 				if err != nil {
 					continue
 				}
@@ -215,20 +476,93 @@ func ParseReleaseFile(file *os.File) (*ReleaseFile, error) {
 	return releaseFile, nil
 }
 
-func downloadFile(client *resty.Client, fileURL url.URL, outputFilePath string) error {
-	resp, err := client.
-		SetRetryCount(3).
-		SetRetryWaitTime(5 * time.Second).
-		SetRetryMaxWaitTime(20 * time.Second).
-		R().
-		SetOutput(outputFilePath).
-		Get(fileURL.String())
+// downloadFileIfModified downloads a file unless it still matches the ETag
+// or the Last-Modified date from a previous download. Returns whether the
+// file was modified and the new ETag and Last-Modified headers.
+func (a *Archive) downloadFileIfModified(ctx context.Context, fileURL url.URL, outputFilePath, etag, lastModified string) (bool, string, string, error) {
+	req := a.Client.R().
+		SetContext(ctx).
+		SetOutput(outputFilePath)
+	if etag != "" {
+		req.SetHeader("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.SetHeader("If-Modified-Since", lastModified)
+	}
+
+	resp, err := req.Get(fileURL.String())
 	if err != nil {
-		return errors.Wrap(err, "failed to fetch Release file")
+		return false, "", "", errors.Wrap(err, "failed to fetch file")
+	}
+	a.downloadedBytes.Add(resp.Size())
+
+	if resp.StatusCode() == http.StatusNotModified {
+		return false, etag, lastModified, nil
 	}
 
 	if resp.IsError() {
-		return fmt.Errorf("failed to fetch file from %v (%v)", fileURL, resp.Status())
+		return false, "", "", fmt.Errorf("failed to fetch file from %v (%v)", fileURL.String(), resp.Status())
+	}
+
+	return true, resp.Header().Get("ETag"), resp.Header().Get("Last-Modified"), nil
+}
+
+func (a *Archive) downloadFile(ctx context.Context, fileURL url.URL, outputFilePath string) error {
+	_, _, _, err := a.downloadFileIfModified(ctx, fileURL, outputFilePath, "", "")
+	return err
+}
+
+// downloadIndex downloads a package index from the first base URL serving
+// a file matching the hash from the Release file
+func (a *Archive) downloadIndex(ctx context.Context, baseURLs []*url.URL, pocket, filePath string, fileInfo ReleaseFileEntry, outputFilePath string) error {
+	tmpFilePath := outputFilePath + ".part"
+	defer os.Remove(tmpFilePath)
+
+	errs := make([]string, 0)
+	for _, baseURL := range baseURLs {
+		fileURL := url.URL(*baseURL)
+		fileURL.Path = path.Join(fileURL.Path, pocket, filePath)
+
+		err := a.downloadFile(ctx, fileURL, tmpFilePath)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			err = checkFileHash(tmpFilePath, fileInfo.Hash)
+		}
+		if err != nil {
+			log.Warnf("[package][%v] failed to download %v: %v", pocket, fileURL.String(), err)
+			a.Mirrors.ReportFailure(baseURL)
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		a.Mirrors.ReportSuccess(baseURL)
+		return os.Rename(tmpFilePath, outputFilePath)
+	}
+
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// checkFileHash verifies the SHA256 sum of a file
+func checkFileHash(filePath, expectedHash string) error {
+	if expectedHash == "" {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	shaSum := sha256.New()
+	if _, err := io.Copy(shaSum, file); err != nil {
+		return err
+	}
+
+	if hash := fmt.Sprintf("%x", shaSum.Sum(nil)); hash != expectedHash {
+		return fmt.Errorf("hash mismatch: expected %v, got %v", expectedHash, hash)
 	}
 
 	return nil
@@ -236,121 +570,288 @@ func downloadFile(client *resty.Client, fileURL url.URL, outputFilePath string)
 
 // DownloadIfNeeded downloads the package index files for the given pocket
 // if the hashes from filesToDownload are direrent from the ones in a.ReleaseInfo
-// returns the number of files downloaded
-func (a *Archive) DownloadIfNeeded(local bool, pocket string, filesToDownload map[string]ReleaseFileEntry, packagesChan chan *debianpkg.PackageInfo) (int, error) {
-	pocketBaseURL := url.URL(*a.BaseURL)
-	pocketBaseURL.Path = path.Join(pocketBaseURL.Path, pocket)
-
-	pocketPortsURL := url.URL(*a.PortsURL)
-	pocketPortsURL.Path = path.Join(pocketPortsURL.Path, pocket)
-
-	nbFile := 0
+// or if opts.Force is set.
+// The files are downloaded from mirror in priority, if not nil.
+// returns the report of each index downloaded and an error if any of
+// them failed
+func (a *Archive) DownloadIfNeeded(ctx context.Context, opts RefreshOptions, pocket string, mirror *url.URL, filesToDownload map[string]ReleaseFileEntry, packagesChan chan *debianpkg.PackageInfo) (map[string]*IndexReport, error) {
+	indexes := make(map[string]*IndexReport)
 	wg := new(sync.WaitGroup)
 	for filePath, fileInfo := range filesToDownload {
-		if a.ReleaseInfo != nil {
+		if a.ReleaseInfo != nil && !opts.Force {
 			if _, ok := a.ReleaseInfo[pocket]; ok && fileInfo.Hash == a.ReleaseInfo[pocket].PackageIndex[filePath].Hash {
 				continue
 			}
 		}
 
-		nbFile++
-		fileURL := url.URL(pocketPortsURL)
-		if strings.Contains(filePath, "amd64") || strings.Contains(filePath, "i386") {
-			fileURL = url.URL(pocketBaseURL)
+		// each goroutine only updates the report of its own index
+		indexes[filePath] = new(IndexReport)
+		baseURL := a.BaseURL
+		if _, arch, ok := parseIndexPath(filePath); ok {
+			baseURL = a.architectureURL(arch)
+		}
+
+		// only the files hosted on the main archive are mirrored
+		baseURLs := []*url.URL{baseURL}
+		if baseURL.String() == a.BaseURL.String() {
+			baseURLs = a.mirrorURLs(mirror)
 		}
-		fileURL.Path = path.Join(fileURL.Path, filePath)
 
+		// the name of the file in the cache doesn't depend on the mirror
+		fileURL := url.URL(*baseURL)
+		fileURL.Path = path.Join(fileURL.Path, pocket, filePath)
 		outputFileName := strings.ReplaceAll(fileURL.Hostname()+fileURL.Path, "/", "_")
 
 		wg.Add(1)
-		go func(fileURL url.URL, fileName string) {
+		go func(report *IndexReport, filePath string, fileInfo ReleaseFileEntry, baseURLs []*url.URL, fileName string) {
 			defer wg.Done()
-			filePath := path.Join(a.CacheDir, fileName)
-			if _, err := os.Stat(filePath); !local || errors.Is(err, os.ErrNotExist) {
-				err := downloadFile(a.Client, fileURL, filePath)
+			outputFilePath := path.Join(a.CacheDir, fileName)
+			if _, err := os.Stat(outputFilePath); !opts.Local || errors.Is(err, os.ErrNotExist) {
+				err := a.downloadIndex(ctx, baseURLs, pocket, filePath, fileInfo, outputFilePath)
 				if err != nil {
-					log.Errorf("error downloading: %v: %v", fileURL.String(), err)
+					log.Errorf("error downloading: %v: %v", filePath, err)
+					report.Error = "failed to download: " + err.Error()
 					return
 				}
-				log.Debugf("[package][%v] Downloaded %v", pocket, filePath)
+				log.Debugf("[package][%v] Downloaded %v", pocket, outputFilePath)
 			}
 
-			err := a.parsePackageIndex(packagesChan, fileName)
+			var err error
+			report.Packages, err = a.parsePackageIndex(ctx, packagesChan, fileName)
 			if err != nil {
 				log.Errorf("failed to parse package index %v: %v", fileName, err)
+				report.Error = "failed to parse: " + err.Error()
 			}
-		}(fileURL, outputFileName)
+		}(indexes[filePath], filePath, fileInfo, baseURLs, outputFileName)
 	}
 
 	wg.Wait()
 
-	return nbFile, nil
+	if ctx.Err() != nil {
+		return indexes, ctx.Err()
+	}
+
+	failed := 0
+	for _, index := range indexes {
+		if index.Error != "" {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return indexes, fmt.Errorf("failed to import %v of %v package indexes", failed, len(indexes))
+	}
+
+	return indexes, nil
 }
 
-func (a *Archive) refreshCacheForPocket(local bool, pocket string, releaseInfo map[string]ReleaseFileEntry, packagesChan chan *debianpkg.PackageInfo) (int, error) {
-	filesToDownload := make(map[string]ReleaseFileEntry)
+// packageIndexes returns the package indexes of the Release file that need
+// to be imported
+func (a *Archive) packageIndexes(releaseFile *ReleaseFile) map[string]ReleaseFileEntry {
+	indexes := make(map[string]ReleaseFileEntry)
 
-	for filePath, info := range releaseInfo {
-		if strings.Contains(filePath, "Packages.gz") && !strings.Contains(filePath, "installer") {
-			filesToDownload[filePath] = info
+	for filePath, info := range releaseFile.PackageIndex {
+		component, arch, ok := parseIndexPath(filePath)
+		if !ok {
+			continue
 		}
-	}
 
-	nbFile, err := a.DownloadIfNeeded(local, pocket, filesToDownload, packagesChan)
-	if err != nil {
-		return nbFile, err
+		// only keep the indexes advertised by the Release file, old
+		// Release files don't list the components or architectures
+		if len(releaseFile.Components) != 0 && !slices.Contains(releaseFile.Components, component) {
+			continue
+		}
+		if len(releaseFile.Architectures) != 0 && !slices.Contains(releaseFile.Architectures, arch) {
+			continue
+		}
+
+		if !a.Components.Match(component) || !a.Architectures.Match(arch) {
+			continue
+		}
+
+		indexes[filePath] = info
 	}
-	return nbFile, nil
+
+	return indexes
+}
+
+func (a *Archive) refreshCacheForPocket(ctx context.Context, opts RefreshOptions, pocket string, releaseFile *ReleaseFile, packagesChan chan *debianpkg.PackageInfo, report *PocketReport) error {
+	filesToDownload := a.packageIndexes(releaseFile)
+
+	indexes, err := a.DownloadIfNeeded(ctx, opts, pocket, releaseFile.Mirror, filesToDownload, packagesChan)
+	report.Indexes = indexes
+
+	return err
 }
 
 // RefreshCache checks if the archive indexes have changed and
-// redownload them if needed
-func (a *Archive) RefreshCache(local bool) (int, int, error) {
-	newInfo, err := a.GetReleaseInfo(local)
+// redownload them if needed. Only one refresh of the archive runs at
+// a time, concurrent calls wait for the running one to finish.
+// The error is nil only if everything was imported, the report details
+// what failed.
+func (a *Archive) RefreshCache(ctx context.Context, opts RefreshOptions) (*RefreshReport, error) {
+	a.refreshMutex.Lock()
+	defer a.refreshMutex.Unlock()
+
+	report := newRefreshReport()
+	err := a.refreshCache(ctx, opts, report)
 	if err != nil {
-		return 0, 0, err
+		report.Error = err.Error()
 	}
-	log.Debug("[release] finished processing release indexes")
+	report.Finished = time.Now()
+	a.setReport(report)
+
+	return report, report.Err()
+}
+
+// Update replaces the configuration of the archive with the one of
+// other, keeping what was already imported. It waits for the running
+// refresh, if any, to finish. The database is not changed. Returns the
+// pockets removed from the configuration, only known if neither
+// configuration discovers them: a pocket missing from a discovery isn't
+// reason enough to delete its packages.
+func (a *Archive) Update(other *Archive) []string {
+	a.refreshMutex.Lock()
+	defer a.refreshMutex.Unlock()
+
+	var removed []string
+	if a.Discovery == nil && other.Discovery == nil {
+		for _, pocket := range a.Pockets {
+			if !slices.Contains(other.Pockets, pocket) {
+				removed = append(removed, pocket)
+			}
+		}
+	}
+
+	a.BaseURL = other.BaseURL
+	a.PortsURL = other.PortsURL
+	a.ArchitectureURLs = other.ArchitectureURLs
+	a.Mirrors = other.Mirrors
+	a.Client = other.Client
+	a.Pockets = other.Pockets
+	a.Discovery = other.Discovery
+	a.Components = other.Components
+	a.Architectures = other.Architectures
+	a.CacheDir = other.CacheDir
+
+	return removed
+}
+
+// Close closes the database of the archive once the running refresh, if
+// any, is finished
+func (a *Archive) Close() error {
+	a.refreshMutex.Lock()
+	defer a.refreshMutex.Unlock()
+
+	return a.Database.Close()
+}
+
+// DeletePockets removes the packages and the release state of pockets
+// from the database, once the running refresh, if any, is finished
+func (a *Archive) DeletePockets(ctx context.Context, pockets []string) error {
+	a.refreshMutex.Lock()
+	defer a.refreshMutex.Unlock()
+
+	for _, pocket := range pockets {
+		log.Infof("[%v] deleting packages of removed pocket %v", a.Name, pocket)
+		err := a.Database.DeletePocket(ctx, a.Name, pocket)
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete pocket %v", pocket)
+		}
+	}
+
+	return nil
+}
 
-	totalNbFile := 0
+func (a *Archive) refreshCache(ctx context.Context, opts RefreshOptions, report *RefreshReport) error {
+	if a.Discovery != nil {
+		pockets, err := a.DiscoverPockets(ctx)
+		if err != nil {
+			log.Errorf("[release] failed to discover pockets, using %v: %v", a.Pockets, err)
+		} else {
+			a.Pockets = pockets
+		}
+	}
+
+	pockets := a.Pockets
+	if len(opts.Pockets) != 0 {
+		for _, pocket := range opts.Pockets {
+			if !slices.Contains(a.Pockets, pocket) {
+				return fmt.Errorf("unknown pocket %v", pocket)
+			}
+		}
+		pockets = opts.Pockets
+	}
+	if len(opts.Suites) != 0 {
+		pockets = slices.DeleteFunc(slices.Clone(pockets), func(pocket string) bool {
+			return !database.MatchSuite(opts.Suites, pocket)
+		})
+	}
+
+	// only contains the pockets that changed
+	newInfo := a.getReleaseInfo(ctx, pockets, opts, report)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.Debug("[release] finished processing release indexes")
 
 	packages := make(chan *debianpkg.PackageInfo, 1000)
+	imported := make(chan importStats)
+	go a.updatePackageInfo(ctx, packages, imported)
+
 	wg := new(sync.WaitGroup)
-	for _, pocket := range a.Pockets {
+	for pocket, releaseFile := range newInfo {
 		wg.Add(1)
-		go func(p string) {
+		go func(p string, releaseFile *ReleaseFile, pocketReport *PocketReport) {
 			defer wg.Done()
-			var (
-				nbFile int
-				err    error
-			)
-
-			// if newInfo[p] does not exists, it means it hasn't changed, there
-			// is nothing to refresh
-			if _, ok := newInfo[p]; !ok {
-				return
-			}
 
-			nbFile, err = a.refreshCacheForPocket(local, p, newInfo[p].PackageIndex, packages)
-			log.Debugf("[packages][%v] refreshed", p)
+			start := time.Now()
+			err := a.refreshCacheForPocket(ctx, opts, p, releaseFile, packages, pocketReport)
+			pocketReport.Duration = time.Since(start)
 			if err != nil {
-				log.Error(err)
+				log.Errorf("[packages][%v] %v", p, err)
 				return
 			}
-			totalNbFile += nbFile
-		}(pocket)
+			log.Debugf("[packages][%v] refreshed", p)
+		}(pocket, releaseFile, report.pocket(pocket))
 	}
 
-	done := make(chan struct{})
-	stats := make(chan int)
-	go a.updatePackageInfo(packages, done, stats)
-
 	wg.Wait()
-	done <- struct{}{}
+	close(packages)
+	stats := <-imported
 
-	a.ReleaseInfo = newInfo
+	for pocket, n := range stats.inserted {
+		report.pocket(pocket).Packages = n
+	}
+	for pocket, n := range stats.failed {
+		report.pocket(pocket).FailedPackages = n
+	}
 
-	return totalNbFile, <-stats, nil
+	// the Release files are only saved once everything was imported,
+	// the pockets interrupted are imported again on the next refresh
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if stats.err != nil {
+		return errors.Wrap(stats.err, "failed to save packages")
+	}
+
+	releaseInfo := make(map[string]*ReleaseFile, len(a.Pockets))
+	for _, pocket := range a.Pockets {
+		if info, ok := newInfo[pocket]; ok && !report.Pockets[pocket].Failed() {
+			releaseInfo[pocket] = info
+			a.saveReleaseState(ctx, info.state)
+			a.setPocketState(pocket, func(state *PocketState) {
+				state.ReleaseDate = info.Date
+				state.ValidUntil = info.ValidUntil
+			})
+		} else if info, ok := a.ReleaseInfo[pocket]; ok {
+			releaseInfo[pocket] = info
+		}
+	}
+	a.ReleaseInfo = releaseInfo
+	a.prunePocketStates(a.Pockets)
+
+	return nil
 }
 
 func uncompressFile(path string) (string, error) {
@@ -374,56 +875,38 @@ func uncompressFile(path string) (string, error) {
 }
 
 // parsePackageIndexFile extracts the package information from an index of packages
-func parsePackageIndexFile(out chan *debianpkg.PackageInfo, rawBody, suite, pocket, component, arch string) error {
+func parsePackageIndexFile(ctx context.Context, out chan *debianpkg.PackageInfo, rawBody, suite, pocket, component, arch string) (int, error) {
 	packageInfo := strings.Split(rawBody, "\n\n")
+	nbPkg := 0
 
 	for _, info := range packageInfo {
-		infoLines := strings.Split(info, "\n")
-		pkgName := ""
-
-		var pkgInfo *debianpkg.PackageInfo
-
-		for _, line := range infoLines {
-			cleanLine := strings.Trim(line, "\n")
-			if cleanLine == "" {
-				continue
-			}
-
-			rawAttribute := strings.Split(cleanLine, ": ")
+		fields := debianpkg.ParseFields(info)
+		if !slices.ContainsFunc(fields, func(field debianpkg.Field) bool { return field.Key == "Package" }) {
+			continue
+		}
 
-			if len(rawAttribute) < 2 {
-				//fmt.Printf("failed to parse property: %#v\n", rawAttribute)
-				continue
-			}
-			key := strings.Clone(rawAttribute[0])
-			value := strings.Clone(strings.TrimPrefix(cleanLine, fmt.Sprintf("%v: ", key)))
-
-			// here we assume that we see Package before any other field
-			// it makes sense but it's also not very safe
-			if key == "Package" {
-				pkgName = value
-				pkgInfo = &debianpkg.PackageInfo{
-					Name:         pkgName,
-					Component:    component,
-					Suite:        suite,
-					Pocket:       pocket,
-					Architecture: arch,
-				}
-			}
-			if pkgInfo != nil {
-				err := pkgInfo.Set(key, value)
-				if err != nil {
-					log.Debugf("[package] error reading maintainer info (%v): %v", pkgInfo.Name, err)
-				}
+		pkgInfo := &debianpkg.PackageInfo{
+			Component:    component,
+			Suite:        suite,
+			Pocket:       pocket,
+			Architecture: arch,
+		}
+		for _, field := range fields {
+			err := pkgInfo.Set(field.Key, field.Value)
+			if err != nil {
+				log.Debugf("[package] error reading %v of %v: %v", field.Key, pkgInfo.Name, err)
 			}
 		}
 
-		if pkgInfo != nil {
-			out <- pkgInfo
+		select {
+		case out <- pkgInfo:
+			nbPkg++
+		case <-ctx.Done():
+			return nbPkg, ctx.Err()
 		}
 	}
 
-	return nil
+	return nbPkg, nil
 }
 
 // getInfoFromIndexName parses the name of a local index file and returns
@@ -454,48 +937,91 @@ func getInfoFromIndexName(name string) (string, string, string, string, error) {
 	return suite, pocket, component, arch, nil
 }
 
-func (a *Archive) parsePackageIndex(out chan *debianpkg.PackageInfo, file string) error {
+func (a *Archive) parsePackageIndex(ctx context.Context, out chan *debianpkg.PackageInfo, file string) (int, error) {
 	filePath := path.Join(a.CacheDir, file)
 	textFile, err := uncompressFile(filePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	suite, pocket, component, arch, err := getInfoFromIndexName(file)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return parsePackageIndexFile(out, textFile, suite, pocket, component, arch)
+	return parsePackageIndexFile(ctx, out, textFile, suite, pocket, component, arch)
 }
 
-func (a *Archive) updatePackageInfo(packages chan *debianpkg.PackageInfo, done chan struct{}, stats chan int) {
-	insertedPkg := 0
+// importStats counts the packages written in the database by pocket
+type importStats struct {
+	inserted map[string]int
+	failed   map[string]int
+	// err is the last transaction error
+	err error
+}
 
-	for {
-		select {
-		case pkg := <-packages:
-			err := a.Database.PrepareInsertPackage(pkg)
+// updatePackageInfo writes the packages in the database until the
+// channel is closed
+func (a *Archive) updatePackageInfo(ctx context.Context, packages chan *debianpkg.PackageInfo, result chan importStats) {
+	stats := importStats{
+		inserted: make(map[string]int),
+		failed:   make(map[string]int),
+	}
+	// packages of the current transaction, by pocket
+	pending := make(map[string]int)
+	var writer database.Writer
 
-			insertedPkg++
+	commit := func() {
+		if writer == nil {
+			return
+		}
+		err := writer.Commit()
+		writer = nil
+		if err != nil {
+			log.Errorf("transaction failed: %v", err)
+			stats.err = err
+		}
 
+		for pocket, n := range pending {
 			if err != nil {
-				log.Errorf("failed to insert package %v in db: %v", pkg.Name, err)
-			}
-			if insertedPkg%10000 == 0 {
-				log.Debugf("Inserted %v packages", insertedPkg)
-				err := a.Database.InsertPrepared()
-				if err != nil {
-					log.Errorf("transaction failed: %v", err)
-				}
+				stats.failed[pocket] += n
+			} else {
+				stats.inserted[pocket] += n
 			}
-		case <-done:
-			err := a.Database.InsertPrepared()
+		}
+		clear(pending)
+	}
+
+	insertedPkg := 0
+	for pkg := range packages {
+		pocket := pkg.Suite + pkg.Pocket
+
+		if writer == nil {
+			var err error
+			writer, err = a.Database.Begin(ctx)
 			if err != nil {
-				log.Errorf("transaction failed: %v", err)
+				log.Errorf("failed to start transaction: %v", err)
+				stats.err = err
+				stats.failed[pocket]++
+				continue
 			}
-			stats <- insertedPkg
-			return
+		}
+
+		err := writer.InsertPackage(ctx, pkg)
+		if err != nil {
+			log.Errorf("failed to insert package %v in db: %v", pkg.Name, err)
+			stats.failed[pocket]++
+			continue
+		}
+
+		pending[pocket]++
+		insertedPkg++
+		if insertedPkg%10000 == 0 {
+			log.Debugf("Inserted %v packages", insertedPkg)
+			commit()
 		}
 	}
+	commit()
+
+	result <- stats
 }
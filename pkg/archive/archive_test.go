@@ -1,10 +1,14 @@
 package archive
 
 import (
+	"context"
 	"io"
+	"net/url"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/gjolly/go-rmadison/pkg/database"
 	"github.com/gjolly/go-rmadison/pkg/debianpkg"
 )
 
@@ -30,6 +34,11 @@ func TestParseReleaseFile(t *testing.T) {
 		}
 	}
 
+	expectedDate := time.Date(2023, 10, 26, 14, 32, 18, 0, time.UTC)
+	if !releaseFile.Date.Equal(expectedDate) {
+		t.Error("wrong date: expected", expectedDate, "got", releaseFile.Date)
+	}
+
 	if releaseFile.Codename != "noble" {
 		t.Error("wrong codename: expected noble, got ", releaseFile.Codename)
 	}
@@ -88,7 +97,7 @@ func TestParsePackageIndexFile(t *testing.T) {
 		}
 	}()
 
-	err = parsePackageIndexFile(pkgInfo, string(fileContent), "jammy", "", "main", "amd64")
+	_, err = parsePackageIndexFile(context.Background(), pkgInfo, string(fileContent), "jammy", "", "main", "amd64")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -158,3 +167,120 @@ func TestGetInfoFromIndexName(t *testing.T) {
 		})
 	}
 }
+
+func TestPackageIndexes(t *testing.T) {
+	nobleReleaseFile, err := os.Open("./testdata/noble-release.txt")
+	if err != nil {
+		t.Fatal("failed to open test file", err)
+	}
+
+	releaseFile, err := ParseReleaseFile(nobleReleaseFile)
+	if err != nil {
+		t.Fatal("failed to parse release file", err)
+	}
+
+	a := &Archive{
+		Components:    Filter{Include: []string{"main", "restricted"}},
+		Architectures: Filter{Include: []string{"amd64", "arm64"}},
+	}
+
+	indexes := a.packageIndexes(releaseFile)
+
+	expected := []string{
+		"main/binary-amd64/Packages.gz",
+		"main/binary-arm64/Packages.gz",
+		"restricted/binary-amd64/Packages.gz",
+		"restricted/binary-arm64/Packages.gz",
+	}
+	if len(indexes) != len(expected) {
+		t.Errorf("expected %v indexes, got %v", len(expected), len(indexes))
+	}
+	for _, filePath := range expected {
+		if _, ok := indexes[filePath]; !ok {
+			t.Error("missing index", filePath)
+		}
+	}
+}
+
+func TestArchitectureURL(t *testing.T) {
+	baseURL, _ := url.Parse("http://archive.ubuntu.com/ubuntu/dists")
+	portsURL, _ := url.Parse("http://ports.ubuntu.com/dists")
+	otherURL, _ := url.Parse("http://riscv.example.com/dists")
+
+	t.Run("ubuntu", func(t *testing.T) {
+		a := &Archive{BaseURL: baseURL, PortsURL: portsURL}
+
+		testTable := map[string]*url.URL{
+			"amd64": baseURL,
+			"i386":  baseURL,
+			"arm64": portsURL,
+			"s390x": portsURL,
+		}
+		for arch, expected := range testTable {
+			if archURL := a.architectureURL(arch); archURL != expected {
+				t.Errorf("%v: expected %v, got %v", arch, expected, archURL)
+			}
+		}
+	})
+
+	t.Run("explicit", func(t *testing.T) {
+		a := &Archive{
+			BaseURL: baseURL,
+			ArchitectureURLs: map[string]*url.URL{
+				"riscv64":       otherURL,
+				AnyArchitecture: portsURL,
+			},
+		}
+
+		testTable := map[string]*url.URL{
+			"amd64":   portsURL,
+			"riscv64": otherURL,
+		}
+		for arch, expected := range testTable {
+			if archURL := a.architectureURL(arch); archURL != expected {
+				t.Errorf("%v: expected %v, got %v", arch, expected, archURL)
+			}
+		}
+	})
+
+	t.Run("no default", func(t *testing.T) {
+		a := &Archive{
+			BaseURL:          baseURL,
+			ArchitectureURLs: map[string]*url.URL{"riscv64": otherURL},
+		}
+
+		if archURL := a.architectureURL("amd64"); archURL != baseURL {
+			t.Errorf("expected %v, got %v", baseURL, archURL)
+		}
+	})
+}
+
+func TestUpdatePackageInfo(t *testing.T) {
+	db := database.NewMemory()
+	a := &Archive{Database: db}
+
+	packages := make(chan *debianpkg.PackageInfo, 3)
+	packages <- &debianpkg.PackageInfo{Name: "hello", Version: "2.10-3", Suite: "noble", Architecture: "amd64"}
+	packages <- &debianpkg.PackageInfo{Name: "hello", Version: "2.10-3ubuntu1", Suite: "noble", Pocket: "-updates", Architecture: "amd64"}
+	packages <- &debianpkg.PackageInfo{Name: "postfix", Version: "3.8.6-1", Suite: "noble", Architecture: "amd64"}
+	close(packages)
+
+	result := make(chan importStats, 1)
+	a.updatePackageInfo(context.Background(), packages, result)
+	stats := <-result
+
+	if stats.err != nil {
+		t.Fatal(stats.err)
+	}
+	if stats.inserted["noble"] != 2 || stats.inserted["noble-updates"] != 1 || len(stats.failed) != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	hello, err := db.GetPackage(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hello) != 2 {
+		t.Errorf("expected hello in 2 pockets, got %v", len(hello))
+	}
+}
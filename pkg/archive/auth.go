@@ -0,0 +1,215 @@
+package archive
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+)
+
+// Auth holds the credentials used to access an archive
+type Auth struct {
+	// Username and Password are used for basic authentication
+	Username string
+	Password string
+	// Token is sent as a bearer token
+	Token string
+	// AuthConf are the entries of an apt auth.conf file, they take
+	// precedence over the other credentials for the URLs they match
+	AuthConf []AuthConfEntry
+	// ClientCert and ClientKey are the paths to a PEM encoded TLS client
+	// certificate and its key
+	ClientCert string
+	ClientKey  string
+	// CACert is the path to a PEM encoded CA certificate to trust in
+	// addition to the system ones
+	CACert string
+}
+
+// AuthConfEntry is a "machine" entry of an apt auth.conf file,
+// see apt_auth.conf(5)
+type AuthConfEntry struct {
+	Scheme   string
+	Host     string
+	Path     string
+	Login    string
+	Password string
+}
+
+// Matches returns true if the entry applies to u. Like apt, an entry
+// without scheme only applies to https, the credentials are never sent
+// in clear text unless the entry asks for it.
+func (e AuthConfEntry) Matches(u *url.URL) bool {
+	scheme := e.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	if scheme != u.Scheme {
+		return false
+	}
+
+	host := u.Host
+	if !strings.Contains(e.Host, ":") {
+		host = u.Hostname()
+	}
+	if e.Host != host {
+		return false
+	}
+
+	if e.Path == "" {
+		return true
+	}
+	entryPath := "/" + strings.Trim(e.Path, "/")
+	return u.Path == entryPath || strings.HasPrefix(u.Path, entryPath+"/")
+}
+
+// ParseAuthConf parses the content of an apt auth.conf file
+func ParseAuthConf(r io.Reader) ([]AuthConfEntry, error) {
+	tokens := make([]string, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuthConfEntry, 0)
+	var entry *AuthConfEntry
+	for i := 0; i < len(tokens); i += 2 {
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("missing value for %q", tokens[i])
+		}
+		key, value := tokens[i], tokens[i+1]
+
+		if key == "machine" {
+			if entry != nil {
+				entries = append(entries, *entry)
+			}
+			entry = new(AuthConfEntry)
+
+			if scheme, rest, ok := strings.Cut(value, "://"); ok {
+				entry.Scheme = scheme
+				value = rest
+			}
+			entry.Host, entry.Path, _ = strings.Cut(value, "/")
+
+			continue
+		}
+
+		if entry == nil {
+			return nil, fmt.Errorf("%q defined before any machine", key)
+		}
+
+		switch key {
+		case "login":
+			entry.Login = value
+		case "password":
+			entry.Password = value
+		default:
+			return nil, fmt.Errorf("unknown token %q", key)
+		}
+	}
+	if entry != nil {
+		entries = append(entries, *entry)
+	}
+
+	return entries, nil
+}
+
+// ReadAuthConf reads and parses an apt auth.conf file
+func ReadAuthConf(filePath string) ([]AuthConfEntry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries, err := ParseAuthConf(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %v", filePath)
+	}
+
+	return entries, nil
+}
+
+// NewClient returns an HTTP client sending the credentials from auth
+func NewClient(auth *Auth) (*resty.Client, error) {
+	// the client is shared by the concurrent downloads, it must not be
+	// configured afterwards
+	client := resty.New().
+		SetRetryCount(3).
+		SetRetryWaitTime(5 * time.Second).
+		SetRetryMaxWaitTime(20 * time.Second)
+	if auth == nil {
+		return client, nil
+	}
+
+	if auth.Token != "" && (auth.Username != "" || auth.Password != "") {
+		return nil, errors.New("basic authentication and token are mutually exclusive")
+	}
+
+	if auth.CACert != "" {
+		pem, err := os.ReadFile(auth.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA certificate")
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %v", auth.CACert)
+		}
+		// before SetCertificates as it replaces the whole TLS config
+		client.SetTLSClientConfig(&tls.Config{RootCAs: pool})
+	}
+
+	if auth.ClientCert != "" || auth.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(auth.ClientCert, auth.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		client.SetCertificates(cert)
+	}
+
+	// credentials are set on each request so that auth.conf entries
+	// can override the archive ones
+	client.OnBeforeRequest(func(c *resty.Client, r *resty.Request) error {
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range auth.AuthConf {
+			if entry.Matches(u) {
+				r.SetBasicAuth(entry.Login, entry.Password)
+				return nil
+			}
+		}
+
+		if auth.Token != "" {
+			r.SetAuthToken(auth.Token)
+		} else if auth.Username != "" || auth.Password != "" {
+			r.SetBasicAuth(auth.Username, auth.Password)
+		}
+
+		return nil
+	})
+
+	return client, nil
+}
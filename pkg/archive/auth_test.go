@@ -0,0 +1,108 @@
+package archive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthConf(t *testing.T) {
+	authConf := `# comment
+machine esm.ubuntu.com/infra/ubuntu/ login bearer password token1
+machine https://private.example.com:8443
+  login user
+  password secret # trailing comment
+`
+
+	entries, err := ParseAuthConf(strings.NewReader(authConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []AuthConfEntry{
+		{Host: "esm.ubuntu.com", Path: "infra/ubuntu/", Login: "bearer", Password: "token1"},
+		{Scheme: "https", Host: "private.example.com:8443", Login: "user", Password: "secret"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %v entries, got %v", len(expected), len(entries))
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("expected %#v, got %#v", expected[i], entries[i])
+		}
+	}
+
+	_, err = ParseAuthConf(strings.NewReader("login user password secret"))
+	if err == nil {
+		t.Error("expected an error for credentials without machine")
+	}
+}
+
+func TestAuthConfEntryMatches(t *testing.T) {
+	entry := AuthConfEntry{Host: "esm.ubuntu.com", Path: "infra/ubuntu/"}
+
+	testTable := map[string]bool{
+		"https://esm.ubuntu.com/infra/ubuntu/dists/xenial/InRelease": true,
+		"http://esm.ubuntu.com/infra/ubuntu":                         false,
+		"https://esm.ubuntu.com/fips/ubuntu/dists/xenial/InRelease":  false,
+		"https://esm.ubuntu.com/infra/ubuntu-other/dists":            false,
+		"https://archive.ubuntu.com/infra/ubuntu/dists":              false,
+	}
+
+	for rawURL, expected := range testTable {
+		t.Run(rawURL, func(t *testing.T) {
+			u, _ := url.Parse(rawURL)
+			if match := entry.Matches(u); match != expected {
+				t.Errorf("expected %v, got %v", expected, match)
+			}
+		})
+	}
+
+	entry.Scheme = "http"
+	u, _ := url.Parse("http://esm.ubuntu.com/infra/ubuntu")
+	if !entry.Matches(u) {
+		t.Errorf("expected an http entry to match %v", u)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+
+	client, err := NewClient(&Auth{
+		Token: "token",
+		AuthConf: []AuthConfEntry{
+			{Scheme: "http", Host: serverURL.Host, Path: "private", Login: "user", Password: "secret"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.R().Get(server.URL + "/public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.String() != "Bearer token" {
+		t.Errorf("expected bearer token, got %q", resp.String())
+	}
+
+	resp, err = client.R().Get(server.URL + "/private/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.String(), "Basic ") {
+		t.Errorf("expected basic auth, got %q", resp.String())
+	}
+
+	_, err = NewClient(&Auth{Username: "user", Token: "token"})
+	if err == nil {
+		t.Error("expected an error with both basic auth and token")
+	}
+}
@@ -0,0 +1,187 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultPocketSuffixes are the pockets looked for for each codename
+// when the discovery is based on a list of codenames
+var DefaultPocketSuffixes = []string{"", "-updates", "-security", "-backports", "-proposed"}
+
+// Filter selects names using shell patterns (see path.Match).
+// An empty Include list matches everything.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+// Match returns true if name is included and not excluded by the filter
+func (f *Filter) Match(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	included := len(f.Include) == 0
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Validate checks that all the patterns of the filter are well formed
+func (f *Filter) Validate() error {
+	if f == nil {
+		return nil
+	}
+
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Discovery describes how the pockets of an archive are found
+type Discovery struct {
+	// Codenames to look for. If empty, the dists/ listing of the
+	// archive is used instead.
+	Codenames []string
+	// Suffixes appended to each codename to get the pockets,
+	// DefaultPocketSuffixes is used if empty.
+	Suffixes []string
+	// Pockets selects which of the discovered pockets are used
+	Pockets Filter
+}
+
+// match the directories in an HTML index page
+var distsListingRegexp = regexp.MustCompile(`href="([^"/?#]+)/"`)
+
+// listDists returns the names of the directories listed in the dists/
+// directory of the archive
+func (a *Archive) listDists(ctx context.Context) ([]string, error) {
+	distsURL := url.URL(*a.BaseURL)
+	distsURL.Path = strings.TrimSuffix(distsURL.Path, "/") + "/"
+
+	resp, err := a.Client.R().SetContext(ctx).Get(distsURL.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("failed to list %v (%v)", distsURL.String(), resp.Status())
+	}
+
+	names := make([]string, 0)
+	for _, match := range distsListingRegexp.FindAllStringSubmatch(resp.String(), -1) {
+		name, err := url.PathUnescape(match[1])
+		if err != nil || name == "." || name == ".." {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// pocketExists checks that the InRelease file of the pocket can be found
+func (a *Archive) pocketExists(ctx context.Context, pocket string) (bool, error) {
+	fileURL, _ := a.getReleaseFileLocationsForPocket(pocket)
+
+	resp, err := a.Client.R().SetContext(ctx).Head(fileURL.String())
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.IsError() {
+		return false, fmt.Errorf("failed to check %v (%v)", fileURL.String(), resp.Status())
+	}
+
+	return true, nil
+}
+
+// DiscoverPockets returns the list of pockets currently published in the
+// archive according to a.Discovery
+func (a *Archive) DiscoverPockets(ctx context.Context) ([]string, error) {
+	if a.Discovery == nil {
+		return a.Pockets, nil
+	}
+
+	pockets := make([]string, 0)
+	if len(a.Discovery.Codenames) == 0 {
+		names, err := a.listDists(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			if a.Discovery.Pockets.Match(name) {
+				pockets = append(pockets, name)
+			}
+		}
+	} else {
+		suffixes := a.Discovery.Suffixes
+		if len(suffixes) == 0 {
+			suffixes = DefaultPocketSuffixes
+		}
+
+		for _, codename := range a.Discovery.Codenames {
+			for _, suffix := range suffixes {
+				pocket := codename + suffix
+				if !a.Discovery.Pockets.Match(pocket) {
+					continue
+				}
+
+				exists, err := a.pocketExists(ctx, pocket)
+				if err != nil {
+					return nil, err
+				}
+				if exists {
+					pockets = append(pockets, pocket)
+				}
+			}
+		}
+	}
+
+	sort.Strings(pockets)
+
+	return pockets, nil
+}
+
+// parseIndexPath returns the component and the architecture of a package
+// index from its path in the Release file (eg. main/binary-amd64/Packages.gz)
+func parseIndexPath(filePath string) (string, string, bool) {
+	parts := strings.Split(filePath, "/")
+	if len(parts) != 3 || parts[2] != "Packages.gz" {
+		return "", "", false
+	}
+
+	arch, ok := strings.CutPrefix(parts[1], "binary-")
+	if !ok {
+		return "", "", false
+	}
+
+	return parts[0], arch, true
+}
@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestFilterMatch(t *testing.T) {
+	type testData struct {
+		Name     string
+		Filter   *Filter
+		Input    string
+		Expected bool
+	}
+
+	testTable := []testData{
+		{"nil filter", nil, "jammy", true},
+		{"empty filter", &Filter{}, "jammy", true},
+		{"included", &Filter{Include: []string{"jammy*"}}, "jammy-updates", true},
+		{"not included", &Filter{Include: []string{"jammy*"}}, "focal", false},
+		{"excluded", &Filter{Exclude: []string{"*-proposed"}}, "jammy-proposed", false},
+		{"included and excluded", &Filter{Include: []string{"jammy*"}, Exclude: []string{"*-proposed"}}, "jammy-proposed", false},
+	}
+
+	for _, testCase := range testTable {
+		t.Run(testCase.Name, func(t *testing.T) {
+			if match := testCase.Filter.Match(testCase.Input); match != testCase.Expected {
+				t.Errorf("expected %v, got %v", testCase.Expected, match)
+			}
+		})
+	}
+}
+
+func TestParseIndexPath(t *testing.T) {
+	type testData struct {
+		Input        string
+		Component    string
+		Architecture string
+		OK           bool
+	}
+
+	testTable := []testData{
+		{"main/binary-amd64/Packages.gz", "main", "amd64", true},
+		{"universe/binary-riscv64/Packages.gz", "universe", "riscv64", true},
+		{"main/binary-amd64/Packages.xz", "", "", false},
+		{"main/debian-installer/binary-amd64/Packages.gz", "", "", false},
+		{"main/source/Sources.gz", "", "", false},
+	}
+
+	for _, testCase := range testTable {
+		t.Run(testCase.Input, func(t *testing.T) {
+			c, a, ok := parseIndexPath(testCase.Input)
+			if ok != testCase.OK {
+				t.Fatalf("expected %v, got %v", testCase.OK, ok)
+			}
+
+			if c != testCase.Component {
+				t.Errorf("expected %v, got %v", testCase.Component, c)
+			}
+
+			if a != testCase.Architecture {
+				t.Errorf("expected %v, got %v", testCase.Architecture, a)
+			}
+		})
+	}
+}
+
+func TestDiscoverPockets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dists/":
+			w.Write([]byte(`<a href="../">Parent</a>
+<a href="jammy/">jammy/</a>
+<a href="jammy-proposed/">jammy-proposed/</a>
+<a href="jammy-updates/">jammy-updates/</a>
+<a href="noble/">noble/</a>`))
+		case "/dists/noble/InRelease", "/dists/noble-updates/InRelease":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.Parse(server.URL + "/dists")
+
+	t.Run("listing", func(t *testing.T) {
+		a := &Archive{
+			BaseURL: baseURL,
+			Client:  resty.New(),
+			Discovery: &Discovery{
+				Pockets: Filter{Exclude: []string{"*-proposed"}},
+			},
+		}
+
+		pockets, err := a.DiscoverPockets(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"jammy", "jammy-updates", "noble"}
+		if !reflect.DeepEqual(pockets, expected) {
+			t.Errorf("expected %v, got %v", expected, pockets)
+		}
+	})
+
+	t.Run("codenames", func(t *testing.T) {
+		a := &Archive{
+			BaseURL: baseURL,
+			Client:  resty.New(),
+			Discovery: &Discovery{
+				Codenames: []string{"noble"},
+			},
+		}
+
+		pockets, err := a.DiscoverPockets(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"noble", "noble-updates"}
+		if !reflect.DeepEqual(pockets, expected) {
+			t.Errorf("expected %v, got %v", expected, pockets)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package archive
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// maxMirrorPenalty bounds how much a failing mirror is penalized so that
+// it can come back quickly once it's healthy again
+const maxMirrorPenalty = 10
+
+type mirror struct {
+	url   *url.URL
+	score int
+}
+
+// Mirrors is a list of locations serving the same archive. The mirrors
+// are tried in order, the ones that recently failed are tried last.
+type Mirrors struct {
+	mutex   sync.Mutex
+	mirrors []*mirror
+}
+
+// NewMirrors returns a list of mirrors tried in the given order
+func NewMirrors(urls []*url.URL) *Mirrors {
+	m := new(Mirrors)
+	for _, u := range urls {
+		m.mirrors = append(m.mirrors, &mirror{url: u})
+	}
+
+	return m
+}
+
+// Ordered returns the URLs of the mirrors, healthiest first
+func (m *Mirrors) Ordered() []*url.URL {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mirrors := make([]*mirror, len(m.mirrors))
+	copy(mirrors, m.mirrors)
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		return mirrors[i].score > mirrors[j].score
+	})
+
+	urls := make([]*url.URL, len(mirrors))
+	for i, mirror := range mirrors {
+		urls[i] = mirror.url
+	}
+
+	return urls
+}
+
+func (m *Mirrors) report(u *url.URL, delta int) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, mirror := range m.mirrors {
+		if mirror.url.String() != u.String() {
+			continue
+		}
+
+		mirror.score += delta
+		if mirror.score > 0 {
+			mirror.score = 0
+		}
+		if mirror.score < -maxMirrorPenalty {
+			mirror.score = -maxMirrorPenalty
+		}
+	}
+}
+
+// ReportSuccess records a successful download from u
+func (m *Mirrors) ReportSuccess(u *url.URL) {
+	m.report(u, 1)
+}
+
+// ReportFailure records a failed download from u
+func (m *Mirrors) ReportFailure(u *url.URL) {
+	m.report(u, -1)
+}
+
+// mirrorURLs returns the base URLs to try, in order, to download files
+// from the archive. preferred, if not nil, is tried first.
+func (a *Archive) mirrorURLs(preferred *url.URL) []*url.URL {
+	if a.Mirrors == nil {
+		return []*url.URL{a.BaseURL}
+	}
+
+	urls := a.Mirrors.Ordered()
+	if preferred == nil {
+		return urls
+	}
+
+	ordered := []*url.URL{preferred}
+	for _, u := range urls {
+		if u.String() != preferred.String() {
+			ordered = append(ordered, u)
+		}
+	}
+
+	return ordered
+}
@@ -0,0 +1,243 @@
+package archive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/database"
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMirrorsOrdered(t *testing.T) {
+	mirror1, _ := url.Parse("http://mirror1.example.com/ubuntu/dists")
+	mirror2, _ := url.Parse("http://mirror2.example.com/ubuntu/dists")
+	upstream, _ := url.Parse("http://archive.ubuntu.com/ubuntu/dists")
+
+	mirrors := NewMirrors([]*url.URL{mirror1, mirror2, upstream})
+
+	expected := []*url.URL{mirror1, mirror2, upstream}
+	if ordered := mirrors.Ordered(); !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("expected %v, got %v", expected, ordered)
+	}
+
+	mirrors.ReportFailure(mirror1)
+	expected = []*url.URL{mirror2, upstream, mirror1}
+	if ordered := mirrors.Ordered(); !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("expected %v, got %v", expected, ordered)
+	}
+
+	mirrors.ReportSuccess(mirror1)
+	expected = []*url.URL{mirror1, mirror2, upstream}
+	if ordered := mirrors.Ordered(); !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("expected %v, got %v", expected, ordered)
+	}
+}
+
+func TestFetchReleaseFileRejectsOlderMirror(t *testing.T) {
+	release := func(date string) string {
+		return "Origin: Ubuntu\nSuite: noble\nDate: " + date + "\n"
+	}
+
+	staleMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(release("Thu, 26 Oct 2023 14:32:18 UTC")))
+	}))
+	defer staleMirror.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(release("Fri, 27 Oct 2023 14:32:18 UTC")))
+	}))
+	defer upstream.Close()
+
+	staleMirrorURL, _ := url.Parse(staleMirror.URL + "/dists")
+	upstreamURL, _ := url.Parse(upstream.URL + "/dists")
+
+	a := &Archive{
+		BaseURL:  upstreamURL,
+		Mirrors:  NewMirrors([]*url.URL{staleMirrorURL, upstreamURL}),
+		Client:   resty.New(),
+		CacheDir: t.TempDir(),
+		ReleaseInfo: map[string]*ReleaseFile{
+			"noble": {Date: time.Date(2023, 10, 27, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	outputFilePath := path.Join(a.CacheDir, "InRelease")
+	mirror, _, err := a.fetchReleaseFile(context.Background(), "noble", outputFilePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mirror != upstreamURL {
+		t.Errorf("expected %v, got %v", upstreamURL, mirror)
+	}
+
+	content, _ := os.ReadFile(outputFilePath)
+	if string(content) != release("Fri, 27 Oct 2023 14:32:18 UTC") {
+		t.Errorf("unexpected Release file: %v", string(content))
+	}
+
+	if ordered := a.Mirrors.Ordered(); ordered[0] != upstreamURL {
+		t.Errorf("expected %v to be ranked first, got %v", upstreamURL, ordered)
+	}
+}
+
+func TestFetchReleaseFileRejectsRollbackAfterRestart(t *testing.T) {
+	date := "Thu, 26 Oct 2023 14:32:18 UTC"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Origin: Ubuntu\nSuite: noble\nDate: " + date + "\n"))
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.Parse(server.URL + "/dists")
+
+	db, err := database.NewConn("sqlite3", path.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the state saved before the restart, ReleaseInfo is empty
+	err = db.SetReleaseState(context.Background(), &database.ReleaseState{
+		Archive: "ubuntu",
+		Pocket:  "noble",
+		URL:     server.URL + "/dists/noble/InRelease",
+		Date:    time.Date(2023, 10, 27, 14, 32, 18, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Archive{
+		Name:     "ubuntu",
+		BaseURL:  baseURL,
+		Client:   resty.New(),
+		CacheDir: t.TempDir(),
+		Database: db,
+	}
+
+	outputFilePath := path.Join(a.CacheDir, "InRelease")
+	_, _, err = a.fetchReleaseFile(context.Background(), "noble", outputFilePath, true)
+	if !errors.Is(err, ErrReleaseNotFresh) {
+		t.Errorf("expected ErrReleaseNotFresh, got %v", err)
+	}
+
+	date = "Sat, 28 Oct 2023 14:32:18 UTC"
+	_, state, err := a.fetchReleaseFile(context.Background(), "noble", outputFilePath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2023, 10, 28, 14, 32, 18, 0, time.UTC); state == nil || !state.Date.Equal(expected) {
+		t.Errorf("expected the state of the new Release file, got %+v", state)
+	}
+
+	// nothing is saved before the pocket is imported
+	saved, err := db.GetReleaseState(context.Background(), "ubuntu", "noble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2023, 10, 27, 14, 32, 18, 0, time.UTC); saved == nil || !saved.Date.Equal(expected) {
+		t.Errorf("expected the previous state to be kept, got %+v", saved)
+	}
+}
+
+func TestFetchReleaseFileConditional(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("Origin: Ubuntu\nSuite: noble\n"))
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.Parse(server.URL + "/dists")
+
+	db, err := database.NewConn("sqlite3", path.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a := &Archive{
+		Name:     "ubuntu",
+		BaseURL:  baseURL,
+		Client:   resty.New(),
+		CacheDir: t.TempDir(),
+		Database: db,
+	}
+
+	outputFilePath := path.Join(a.CacheDir, "InRelease")
+	for i := 0; i < 2; i++ {
+		_, state, err := a.fetchReleaseFile(context.Background(), "noble", outputFilePath, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (state != nil) != (i == 0) {
+			t.Errorf("request %v: unexpected state %+v", i, state)
+		}
+		// as if the pocket was imported
+		a.saveReleaseState(context.Background(), state)
+	}
+
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %v", requests)
+	}
+
+	// the 304 response must not overwrite the cached file
+	content, _ := os.ReadFile(outputFilePath)
+	if string(content) != "Origin: Ubuntu\nSuite: noble\n" {
+		t.Errorf("unexpected Release file: %q", string(content))
+	}
+
+	state, err := db.GetReleaseState(context.Background(), "ubuntu", "noble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || state.ETag != `"v1"` {
+		t.Errorf("unexpected state %#v", state)
+	}
+}
+
+func TestFetchReleaseFileCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// hangs until the client gives up
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	mirrorURL, _ := url.Parse(server.URL + "/dists")
+	upstreamURL, _ := url.Parse("http://archive.example.com/ubuntu/dists")
+
+	a := &Archive{
+		BaseURL:  upstreamURL,
+		Mirrors:  NewMirrors([]*url.URL{mirrorURL, upstreamURL}),
+		Client:   resty.New(),
+		CacheDir: t.TempDir(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, _, err := a.fetchReleaseFile(ctx, "noble", path.Join(a.CacheDir, "InRelease"), true)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the mirror isn't blamed for the cancellation
+	if ordered := a.Mirrors.Ordered(); ordered[0] != mirrorURL {
+		t.Errorf("expected %v to still be ranked first, got %v", mirrorURL, ordered)
+	}
+}
@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IndexReport is the result of the import of a package index
+type IndexReport struct {
+	// Packages is the number of packages read from the index
+	Packages int    `json:"packages"`
+	Error    string `json:"error,omitempty"`
+}
+
+// PocketReport is the result of the refresh of a pocket
+type PocketReport struct {
+	// Unchanged is true if the Release file didn't change since the
+	// last refresh, nothing was imported
+	Unchanged bool          `json:"unchanged,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	// Indexes are the package indexes downloaded, by path
+	Indexes map[string]*IndexReport `json:"indexes,omitempty"`
+	// Packages is the number of packages written in the database and
+	// FailedPackages the number of packages that couldn't be
+	Packages       int `json:"packages"`
+	FailedPackages int `json:"failed_packages,omitempty"`
+	// Error is the reason why the Release file of the pocket couldn't
+	// be imported
+	Error string `json:"error,omitempty"`
+}
+
+// Failed is true if anything went wrong when refreshing the pocket
+func (r *PocketReport) Failed() bool {
+	if r.Error != "" || r.FailedPackages != 0 {
+		return true
+	}
+
+	for _, index := range r.Indexes {
+		if index.Error != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Err returns what went wrong when refreshing the pocket, nil if nothing
+// did
+func (r *PocketReport) Err() error {
+	errs := make([]string, 0)
+	if r.Error != "" {
+		errs = append(errs, r.Error)
+	}
+
+	for indexPath, index := range r.Indexes {
+		if index.Error != "" {
+			errs = append(errs, fmt.Sprintf("%v: %v", indexPath, index.Error))
+		}
+	}
+	if r.FailedPackages != 0 {
+		errs = append(errs, fmt.Sprintf("failed to insert %v packages", r.FailedPackages))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+
+	return errors.New(strings.Join(errs, ", "))
+}
+
+// RefreshReport is the result of a refresh of an archive
+type RefreshReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Pockets are the pockets refreshed, by name
+	Pockets map[string]*PocketReport `json:"pockets"`
+	// Error is the reason why the refresh didn't run to completion
+	Error string `json:"error,omitempty"`
+
+	// protects Pockets while the refresh is running
+	mutex sync.Mutex
+}
+
+func newRefreshReport() *RefreshReport {
+	return &RefreshReport{
+		Started: time.Now(),
+		Pockets: make(map[string]*PocketReport),
+	}
+}
+
+// pocket returns the report of a pocket, creating it if needed
+func (r *RefreshReport) pocket(name string) *PocketReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	report, ok := r.Pockets[name]
+	if !ok {
+		report = &PocketReport{
+			Indexes: make(map[string]*IndexReport),
+		}
+		r.Pockets[name] = report
+	}
+
+	return report
+}
+
+// Files returns the number of package indexes downloaded
+func (r *RefreshReport) Files() int {
+	files := 0
+	for _, pocket := range r.Pockets {
+		files += len(pocket.Indexes)
+	}
+
+	return files
+}
+
+// Packages returns the number of packages written in the database
+func (r *RefreshReport) Packages() int {
+	packages := 0
+	for _, pocket := range r.Pockets {
+		packages += pocket.Packages
+	}
+
+	return packages
+}
+
+// FailedPockets returns the names of the pockets that failed, sorted
+func (r *RefreshReport) FailedPockets() []string {
+	failed := make([]string, 0)
+	for name, pocket := range r.Pockets {
+		if pocket.Failed() {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+
+	return failed
+}
+
+// Err returns an error describing everything that went wrong during the
+// refresh, nil if it fully succeeded
+func (r *RefreshReport) Err() error {
+	errs := make([]string, 0)
+	if r.Error != "" {
+		errs = append(errs, r.Error)
+	}
+
+	for _, name := range r.FailedPockets() {
+		errs = append(errs, fmt.Sprintf("%v: %v", name, r.Pockets[name].Err()))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errors.New(strings.Join(errs, "; "))
+}
@@ -0,0 +1,190 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/database"
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+	"github.com/go-resty/resty/v2"
+)
+
+func TestRefreshReport(t *testing.T) {
+	report := newRefreshReport()
+	report.pocket("noble").Unchanged = true
+
+	updates := report.pocket("noble-updates")
+	updates.Packages = 10
+	updates.Indexes["main/binary-amd64/Packages.gz"] = &IndexReport{Packages: 10}
+
+	if err := report.Err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	security := report.pocket("noble-security")
+	security.Indexes["main/binary-amd64/Packages.gz"] = &IndexReport{Error: "failed to download"}
+	report.pocket("noble-backports").Error = "Release file is not fresh"
+
+	if report.Files() != 2 {
+		t.Errorf("expected 2 files, got %v", report.Files())
+	}
+	if report.Packages() != 10 {
+		t.Errorf("expected 10 packages, got %v", report.Packages())
+	}
+
+	expected := []string{"noble-backports", "noble-security"}
+	if failed := report.FailedPockets(); !reflect.DeepEqual(failed, expected) {
+		t.Errorf("expected %v, got %v", expected, failed)
+	}
+
+	expectedErr := "noble-backports: Release file is not fresh; noble-security: main/binary-amd64/Packages.gz: failed to download"
+	if err := report.Err(); err == nil || err.Error() != expectedErr {
+		t.Errorf("expected %v, got %v", expectedErr, err)
+	}
+}
+
+func TestDownloadIfNeededReportsFailedIndexes(t *testing.T) {
+	index := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(index)
+	gzipWriter.Write([]byte("Package: hello\nVersion: 2.10-3\n\nPackage: postfix\nVersion: 3.8.6-1\n"))
+	gzipWriter.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dists/noble/main/binary-amd64/Packages.gz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(index.Bytes())
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.Parse(server.URL + "/dists")
+	a := &Archive{
+		BaseURL:          baseURL,
+		ArchitectureURLs: map[string]*url.URL{AnyArchitecture: baseURL},
+		Client:           resty.New(),
+		CacheDir:         t.TempDir(),
+	}
+
+	packages := make(chan *debianpkg.PackageInfo, 10)
+	indexes, err := a.DownloadIfNeeded(context.Background(), RefreshOptions{}, "noble", nil, map[string]ReleaseFileEntry{
+		"main/binary-amd64/Packages.gz":     {},
+		"universe/binary-amd64/Packages.gz": {},
+	}, packages)
+	if err == nil {
+		t.Error("expected an error for the missing index")
+	}
+
+	if indexes["main/binary-amd64/Packages.gz"].Packages != 2 || indexes["main/binary-amd64/Packages.gz"].Error != "" {
+		t.Errorf("unexpected report for main: %+v", indexes["main/binary-amd64/Packages.gz"])
+	}
+	if indexes["universe/binary-amd64/Packages.gz"].Error == "" {
+		t.Errorf("expected an error for universe: %+v", indexes["universe/binary-amd64/Packages.gz"])
+	}
+	if len(packages) != 2 {
+		t.Errorf("expected 2 packages, got %v", len(packages))
+	}
+}
+
+func TestRefreshCacheSuites(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	baseURL, _ := url.Parse(server.URL + "/dists")
+	a := &Archive{
+		Name:     "ubuntu",
+		BaseURL:  baseURL,
+		Pockets:  []string{"jammy", "noble", "noble-updates"},
+		Client:   resty.New(),
+		CacheDir: t.TempDir(),
+		Database: database.NewMemory(),
+	}
+
+	report, _ := a.RefreshCache(context.Background(), RefreshOptions{Suites: []string{"noble"}})
+
+	pockets := make([]string, 0)
+	for pocket := range report.Pockets {
+		pockets = append(pockets, pocket)
+	}
+	sort.Strings(pockets)
+	if !reflect.DeepEqual(pockets, []string{"noble", "noble-updates"}) {
+		t.Errorf("expected the pockets of noble to be refreshed, got %v", pockets)
+	}
+}
+
+func TestRefreshCacheSavesReleaseStateAfterImport(t *testing.T) {
+	index := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(index)
+	gzipWriter.Write([]byte("Package: hello\nVersion: 2.10-3\nArchitecture: amd64\n"))
+	gzipWriter.Close()
+
+	release := fmt.Sprintf("Origin: Ubuntu\nSuite: noble\nDate: Thu, 26 Oct 2023 14:32:18 UTC\nSHA256:\n %x %v main/binary-amd64/Packages.gz\n",
+		sha256.Sum256(index.Bytes()), index.Len())
+
+	indexAvailable := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/dists/noble/InRelease":
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(release))
+		case r.URL.Path == "/dists/noble/main/binary-amd64/Packages.gz" && indexAvailable:
+			w.Write(index.Bytes())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.Parse(server.URL + "/dists")
+	a := &Archive{
+		Name:             "ubuntu",
+		BaseURL:          baseURL,
+		ArchitectureURLs: map[string]*url.URL{AnyArchitecture: baseURL},
+		Pockets:          []string{"noble"},
+		Client:           resty.New(),
+		CacheDir:         t.TempDir(),
+		Database:         database.NewMemory(),
+	}
+
+	_, err := a.RefreshCache(context.Background(), RefreshOptions{})
+	if err == nil {
+		t.Fatal("expected the missing index to fail the refresh")
+	}
+	state, err := a.Database.GetReleaseState(context.Background(), "ubuntu", "noble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != nil {
+		t.Errorf("expected no state before the pocket is imported, got %+v", state)
+	}
+	if date := a.PocketStates()["noble"].ReleaseDate; !date.IsZero() {
+		t.Errorf("expected no Release date before the pocket is imported, got %v", date)
+	}
+
+	indexAvailable = true
+	_, err = a.RefreshCache(context.Background(), RefreshOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = a.Database.GetReleaseState(context.Background(), "ubuntu", "noble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDate := time.Date(2023, 10, 26, 14, 32, 18, 0, time.UTC)
+	if state == nil || state.ETag != `"v1"` || !state.Date.Equal(expectedDate) {
+		t.Errorf("expected the state to be saved once imported, got %+v", state)
+	}
+	if date := a.PocketStates()["noble"].ReleaseDate; !date.Equal(expectedDate) {
+		t.Errorf("expected Release date %v, got %v", expectedDate, date)
+	}
+}
@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReleaseNotFresh is returned when a Release file is expired or older
+// than the one already imported
+var ErrReleaseNotFresh = errors.New("Release file is not fresh")
+
+// PocketState describes the freshness of a pocket
+type PocketState struct {
+	// ReleaseDate and ValidUntil come from the imported Release file
+	ReleaseDate time.Time `json:"release_date"`
+	ValidUntil  time.Time `json:"valid_until"`
+	// Expired is true if the imported Release file is past ValidUntil
+	Expired bool `json:"expired"`
+	// LastChecked is the last time the Release file was fetched
+	LastChecked time.Time `json:"last_checked"`
+	// Rejected is the reason why the last Release file fetched was not
+	// imported, empty if it was
+	Rejected string `json:"rejected,omitempty"`
+	// LastRefresh is the last time the pocket was successfully refreshed
+	LastRefresh time.Time `json:"last_refresh"`
+	// RefreshDuration is how long the last import of the pocket took
+	RefreshDuration time.Duration `json:"refresh_duration"`
+	// ImportedPackages and Failures are counted since the server started
+	ImportedPackages int `json:"imported_packages"`
+	Failures         int `json:"failures"`
+	// Error is the error of the last refresh, empty if it succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// ArchiveState describes the last refresh of an archive
+type ArchiveState struct {
+	// Refreshed is true once a refresh of the archive ran to completion,
+	// even if some pockets failed
+	Refreshed bool `json:"refreshed"`
+	// LastRefresh is the end of the last successful refresh
+	LastRefresh time.Time `json:"last_refresh"`
+	// LastAttempt is the end of the last refresh, successful or not
+	LastAttempt time.Time `json:"last_attempt"`
+	// Error is the error of the last refresh, empty if it succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// pocketState returns the state of a pocket, a.stateMutex must be held
+func (a *Archive) pocketState(pocket string) *PocketState {
+	if a.states == nil {
+		a.states = make(map[string]*PocketState)
+	}
+	if _, ok := a.states[pocket]; !ok {
+		a.states[pocket] = new(PocketState)
+	}
+
+	return a.states[pocket]
+}
+
+func (a *Archive) setPocketState(pocket string, update func(*PocketState)) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	update(a.pocketState(pocket))
+}
+
+// State returns the state of the archive
+func (a *Archive) State() ArchiveState {
+	a.stateMutex.RLock()
+	defer a.stateMutex.RUnlock()
+
+	return a.state
+}
+
+// LastReport returns the report of the last refresh, nil if the archive
+// was never refreshed
+func (a *Archive) LastReport() *RefreshReport {
+	a.stateMutex.RLock()
+	defer a.stateMutex.RUnlock()
+
+	return a.lastReport
+}
+
+// setReport updates the state of the archive and of its pockets with the
+// result of a refresh
+func (a *Archive) setReport(report *RefreshReport) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	a.lastReport = report
+
+	for pocket, pocketReport := range report.Pockets {
+		state := a.pocketState(pocket)
+		if !pocketReport.Unchanged {
+			state.RefreshDuration = pocketReport.Duration
+		}
+		state.ImportedPackages += pocketReport.Packages
+
+		state.Error = ""
+		if pocketReport.Failed() {
+			state.Failures++
+			state.Error = pocketReport.Err().Error()
+		} else {
+			state.LastRefresh = report.Finished
+		}
+	}
+
+	a.state.LastAttempt = report.Finished
+	a.state.Error = ""
+	if err := report.Err(); err != nil {
+		a.state.Error = err.Error()
+	} else {
+		a.state.LastRefresh = a.state.LastAttempt
+	}
+	if report.Error == "" {
+		a.state.Refreshed = true
+	}
+}
+
+// PocketStates returns the state of the pockets of the archive
+func (a *Archive) PocketStates() map[string]PocketState {
+	a.stateMutex.RLock()
+	defer a.stateMutex.RUnlock()
+
+	now := time.Now()
+	states := make(map[string]PocketState, len(a.states))
+	for pocket, state := range a.states {
+		s := *state
+		s.Expired = !s.ValidUntil.IsZero() && s.ValidUntil.Before(now)
+		states[pocket] = s
+	}
+
+	return states
+}
+
+// prunePocketStates forgets about the pockets not in the list
+func (a *Archive) prunePocketStates(pockets []string) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	for pocket := range a.states {
+		if !slices.Contains(pockets, pocket) {
+			delete(a.states, pocket)
+		}
+	}
+}
+
+// DownloadedBytes returns the number of bytes downloaded from the archive
+func (a *Archive) DownloadedBytes() int64 {
+	return a.downloadedBytes.Load()
+}
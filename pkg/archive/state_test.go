@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gjolly/go-rmadison/pkg/database"
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+	"github.com/pkg/errors"
+)
+
+func TestCheckReleaseFreshness(t *testing.T) {
+	type testData struct {
+		Name     string
+		Release  string
+		Previous *ReleaseFile
+		Fresh    bool
+	}
+
+	validUntil := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC1123)
+
+	testTable := []testData{
+		{
+			"first release",
+			"Date: Thu, 26 Oct 2023 14:32:18 UTC\n",
+			nil,
+			true,
+		},
+		{
+			"newer release",
+			"Date: Fri, 27 Oct 2023 14:32:18 UTC\nValid-Until: " + validUntil + "\n",
+			&ReleaseFile{Date: time.Date(2023, 10, 26, 14, 32, 18, 0, time.UTC)},
+			true,
+		},
+		{
+			"older release",
+			"Date: Wed, 25 Oct 2023 14:32:18 UTC\n",
+			&ReleaseFile{Date: time.Date(2023, 10, 26, 14, 32, 18, 0, time.UTC)},
+			false,
+		},
+		{
+			"expired release",
+			"Date: Thu, 26 Oct 2023 14:32:18 UTC\nValid-Until: Fri, 27 Oct 2023 14:32:18 UTC\n",
+			nil,
+			false,
+		},
+	}
+
+	for _, testCase := range testTable {
+		t.Run(testCase.Name, func(t *testing.T) {
+			filePath := path.Join(t.TempDir(), "InRelease")
+			err := os.WriteFile(filePath, []byte(testCase.Release), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			a := &Archive{ReleaseInfo: make(map[string]*ReleaseFile)}
+			if testCase.Previous != nil {
+				a.ReleaseInfo["noble"] = testCase.Previous
+			}
+
+			_, err = a.checkReleaseFreshness("noble", filePath, time.Time{})
+			if testCase.Fresh && err != nil {
+				t.Error("unexpected error", err)
+			}
+			if !testCase.Fresh && !errors.Is(err, ErrReleaseNotFresh) {
+				t.Error("expected ErrReleaseNotFresh, got", err)
+			}
+		})
+	}
+}
+
+func TestPocketStates(t *testing.T) {
+	a := new(Archive)
+
+	a.setPocketState("noble", func(state *PocketState) {
+		state.ValidUntil = time.Now().Add(-time.Hour)
+	})
+	a.setPocketState("jammy", func(state *PocketState) {
+		state.ValidUntil = time.Now().Add(time.Hour)
+	})
+
+	states := a.PocketStates()
+	if !states["noble"].Expired {
+		t.Error("expected noble to be expired")
+	}
+	if states["jammy"].Expired {
+		t.Error("expected jammy not to be expired")
+	}
+
+	a.prunePocketStates([]string{"jammy"})
+	if _, ok := a.PocketStates()["noble"]; ok {
+		t.Error("expected noble to be pruned")
+	}
+}
+
+func TestUpdateRemovedPockets(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemory()
+
+	writer, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range []*debianpkg.PackageInfo{
+		{Name: "hello", Version: "1", Suite: "noble", Architecture: "amd64"},
+		{Name: "hello", Version: "2", Suite: "noble", Pocket: "-updates", Architecture: "amd64"},
+	} {
+		err = writer.InsertPackage(ctx, pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writer.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Archive{
+		Pockets:  []string{"noble", "noble-updates"},
+		Database: db,
+	}
+	removed := a.Update(&Archive{Pockets: []string{"noble", "jammy"}})
+	if !reflect.DeepEqual(removed, []string{"noble-updates"}) {
+		t.Errorf("expected noble-updates to be removed, got %v", removed)
+	}
+
+	// the pockets discovered can't be trusted to delete packages
+	discovered := &Archive{Discovery: &Discovery{Codenames: []string{"jammy"}}}
+	if removed := a.Update(discovered); len(removed) != 0 {
+		t.Errorf("expected no pocket removed with discovery, got %v", removed)
+	}
+	if removed := discovered.Update(&Archive{Pockets: []string{"jammy"}}); len(removed) != 0 {
+		t.Errorf("expected no pocket removed with discovery, got %v", removed)
+	}
+
+	err = a.DeletePockets(ctx, []string{"noble-updates"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := db.CountPackagesPerPocket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts["noble"] != 1 {
+		t.Errorf("expected only noble to be left, got %v", counts)
+	}
+}
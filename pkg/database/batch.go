@@ -0,0 +1,423 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+	"github.com/pkg/errors"
+)
+
+// InsertOptions tune how the packages are written
+type InsertOptions struct {
+	// PrepareStatements prepares the statements once per batch instead
+	// of once per package
+	PrepareStatements bool
+	// MultiRowValues inserts all the relations and extra fields of a
+	// package with one statement
+	MultiRowValues bool
+	// Tune changes the settings of the dialect speeding up the import
+	// on the connection of the batch, eg. a larger cache for SQLite and
+	// no sync. They are restored at the end of the batch.
+	Tune bool
+}
+
+// DefaultInsertOptions are the options of the connections returned by
+// NewConn. The other options are opt-in: they change the speed by a few
+// percent at most in BenchmarkInsertPackages, eg. ~9.4k packages/s with
+// MultiRowValues against ~9.0k without, which is within the noise of
+// the runs, and Tune trades durability for speed.
+var DefaultInsertOptions = InsertOptions{
+	PrepareStatements: true,
+}
+
+// maxParameters is the number of parameters a statement can have with
+// all the supported databases, 999 for old SQLite versions
+const maxParameters = 999
+
+var relationsColumns = []string{
+	"package_id",
+	"field",
+	"ordinal",
+	"alternative",
+	"name",
+	"arch_qualifier",
+	"operator",
+	"version",
+	"restrictions",
+}
+
+// batch writes packages in a transaction, it's the Writer of a DB
+type batch struct {
+	dialect *dialect
+	options InsertOptions
+
+	// mutex guards everything below, the transaction can't be used by
+	// several goroutines at once
+	mutex sync.Mutex
+	done  bool
+	// writers is released at the end of the batch
+	writers chan struct{}
+
+	// conn is only set when the connection was tuned for the batch
+	conn *sql.Conn
+	// reset are the statements restoring the settings of conn
+	reset []string
+	tx    *sql.Tx
+
+	// statements are the prepared statements by query
+	statements map[string]*sql.Stmt
+	// maintainers are the IDs of the maintainers seen in the batch
+	maintainers map[debianpkg.PackageMaintainer]sql.NullInt64
+}
+
+func newBatch(ctx context.Context, db *DB) (*batch, error) {
+	b := &batch{
+		dialect:     db.dialect,
+		options:     db.InsertOptions,
+		statements:  make(map[string]*sql.Stmt),
+		maintainers: make(map[debianpkg.PackageMaintainer]sql.NullInt64),
+	}
+
+	if db.writers != nil {
+		select {
+		case db.writers <- struct{}{}:
+			b.writers = db.writers
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	err := b.begin(ctx, db)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *batch) begin(ctx context.Context, db *DB) error {
+	var err error
+	if !b.options.Tune || len(b.dialect.tune) == 0 {
+		b.tx, err = db.BeginTx(ctx, nil)
+		return err
+	}
+
+	// the settings only apply to one connection, it's kept until the
+	// end of the batch
+	b.conn, err = db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	for _, setting := range b.dialect.tune {
+		var current string
+		err = b.conn.QueryRowContext(ctx, setting.get).Scan(&current)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read connection setting (%v)", setting.get)
+		}
+
+		set := fmt.Sprintf(setting.set, setting.value)
+		_, err = b.conn.ExecContext(ctx, set)
+		if err != nil {
+			return errors.Wrapf(err, "failed to tune connection (%v)", set)
+		}
+		b.reset = append(b.reset, fmt.Sprintf(setting.set, current))
+	}
+
+	b.tx, err = b.conn.BeginTx(ctx, nil)
+
+	return err
+}
+
+// release restores the settings of the connection, returns it to the
+// pool and lets the next writer start
+func (b *batch) release() {
+	if b.writers != nil {
+		defer func() { <-b.writers }()
+	}
+	if b.conn == nil {
+		return
+	}
+
+	for _, reset := range b.reset {
+		_, err := b.conn.ExecContext(context.Background(), reset)
+		if err != nil {
+			// don't return a tuned connection to the pool
+			b.conn.Raw(func(any) error { return driver.ErrBadConn })
+			log.Errorf("failed to reset connection (%v): %v", reset, err)
+			break
+		}
+	}
+	b.conn.Close()
+	b.conn = nil
+}
+
+// InsertPackage adds a package to the transaction
+func (b *batch) InsertPackage(ctx context.Context, pkgInfo *debianpkg.PackageInfo) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.done {
+		return ErrWriterClosed
+	}
+
+	// a package that fails is rolled back alone: SQLite would commit
+	// its first rows with the batch and PostgreSQL would abort the
+	// whole transaction
+	_, err := b.tx.ExecContext(ctx, "SAVEPOINT package")
+	if err != nil {
+		return errors.Wrap(err, "failed to create savepoint")
+	}
+
+	err = b.insertPackage(ctx, pkgInfo)
+	if err != nil {
+		// the maintainers it added are rolled back too
+		clear(b.maintainers)
+
+		_, rollbackErr := b.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT package")
+		if rollbackErr != nil {
+			// the package may be half written, don't commit it
+			b.end(false)
+			return errors.Wrapf(err, "failed to roll back package (%v)", rollbackErr)
+		}
+
+		return err
+	}
+
+	_, err = b.tx.ExecContext(ctx, "RELEASE SAVEPOINT package")
+
+	return errors.Wrap(err, "failed to release savepoint")
+}
+
+// Commit commits the transaction, it's rolled back if that fails
+func (b *batch) Commit() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.done {
+		return ErrWriterClosed
+	}
+
+	return b.end(true)
+}
+
+// Rollback rolls back the transaction
+func (b *batch) Rollback() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.done {
+		return nil
+	}
+
+	return b.end(false)
+}
+
+// end commits the batch, or rolls it back, and releases everything
+func (b *batch) end(commit bool) error {
+	b.done = true
+
+	var err error
+	if commit {
+		err = b.tx.Commit()
+	}
+	if !commit || err != nil {
+		b.tx.Rollback()
+	}
+
+	for _, statement := range b.statements {
+		statement.Close()
+	}
+	b.release()
+
+	return err
+}
+
+func (b *batch) statement(ctx context.Context, query string) (*sql.Stmt, error) {
+	statement, ok := b.statements[query]
+	if ok {
+		return statement, nil
+	}
+
+	statement, err := b.tx.PrepareContext(ctx, b.dialect.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	b.statements[query] = statement
+
+	return statement, nil
+}
+
+func (b *batch) exec(ctx context.Context, query string, args ...any) error {
+	if !b.options.PrepareStatements {
+		_, err := b.tx.ExecContext(ctx, b.dialect.rebind(query), args...)
+		return err
+	}
+
+	statement, err := b.statement(ctx, query)
+	if err != nil {
+		return err
+	}
+	_, err = statement.ExecContext(ctx, args...)
+
+	return err
+}
+
+func (b *batch) queryRow(ctx context.Context, query string, args []any, dest ...any) error {
+	if !b.options.PrepareStatements {
+		return b.tx.QueryRowContext(ctx, b.dialect.rebind(query), args...).Scan(dest...)
+	}
+
+	statement, err := b.statement(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	return statement.QueryRowContext(ctx, args...).Scan(dest...)
+}
+
+// insertRows inserts rows in a table, with as few statements as
+// possible if MultiRowValues is set
+func (b *batch) insertRows(ctx context.Context, table string, columns []string, rows [][]any) error {
+	rowsPerStatement := 1
+	if b.options.MultiRowValues {
+		rowsPerStatement = maxParameters / len(columns)
+	}
+
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	for len(rows) != 0 {
+		n := min(len(rows), rowsPerStatement)
+
+		args := make([]any, 0, n*len(columns))
+		for _, row := range rows[:n] {
+			args = append(args, row...)
+		}
+		query := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES " +
+			strings.TrimSuffix(strings.Repeat(placeholders+", ", n), ", ")
+
+		err := b.exec(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+
+	return nil
+}
+
+// insertPackage writes a package, replacing the one with the same name,
+// component, suite, pocket and architecture
+func (b *batch) insertPackage(ctx context.Context, pkgInfo *debianpkg.PackageInfo) error {
+	maintainerID, err := b.maintainerID(ctx, pkgInfo.Maintainer)
+	if err != nil {
+		return err
+	}
+	originalMaintainerID, err := b.maintainerID(ctx, pkgInfo.OriginalMaintainer)
+	if err != nil {
+		return err
+	}
+
+	var phasedUpdatePercentage sql.NullInt64
+	if pkgInfo.PhasedUpdatePercentage != nil {
+		phasedUpdatePercentage.Valid = true
+		phasedUpdatePercentage.Int64 = int64(*pkgInfo.PhasedUpdatePercentage)
+	}
+
+	var packageID int64
+	err = b.queryRow(ctx, upsert("packages", packagesColumns, packagesKey)+" RETURNING id", []any{
+		pkgInfo.Name,
+		pkgInfo.Version,
+		pkgInfo.Component,
+		pkgInfo.Suite,
+		pkgInfo.Pocket,
+		pkgInfo.Architecture,
+		pkgInfo.Source,
+		pkgInfo.Section,
+		maintainerID,
+		pkgInfo.InstalledSize,
+		pkgInfo.Description,
+		pkgInfo.Priority,
+		pkgInfo.MultiArch,
+		pkgInfo.Homepage,
+		originalMaintainerID,
+		pkgInfo.DescriptionMD5,
+		phasedUpdatePercentage,
+	}, &packageID)
+	if err != nil {
+		return err
+	}
+
+	err = b.exec(ctx, upsert("files",
+		[]string{"package_id", "file_name", "size", "sha256", "md5sum", "sha1", "sha512"}, []string{"package_id"}),
+		packageID,
+		pkgInfo.FileName,
+		pkgInfo.Size,
+		pkgInfo.SHA256,
+		pkgInfo.MD5sum,
+		pkgInfo.SHA1,
+		pkgInfo.SHA512,
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert file")
+	}
+
+	err = b.exec(ctx, "DELETE FROM relations WHERE package_id=?", packageID)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete relations")
+	}
+	relations := make([][]any, 0)
+	for _, field := range relationFields {
+		relations = append(relations, relationRows(packageID, field.name, *field.values(pkgInfo))...)
+	}
+	err = b.insertRows(ctx, "relations", relationsColumns, relations)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert relations")
+	}
+
+	err = b.exec(ctx, "DELETE FROM extra_fields WHERE package_id=?", packageID)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete extra fields")
+	}
+	extraFields := make([][]any, 0, len(pkgInfo.Extra))
+	for field, value := range pkgInfo.Extra {
+		extraFields = append(extraFields, []any{packageID, field, value})
+	}
+	err = b.insertRows(ctx, "extra_fields", []string{"package_id", "field", "value"}, extraFields)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert extra fields")
+	}
+
+	return nil
+}
+
+// maintainerID returns the ID of a maintainer, adding it if needed. The
+// ID is NULL if maintainer is nil or empty.
+func (b *batch) maintainerID(ctx context.Context, maintainer *debianpkg.PackageMaintainer) (sql.NullInt64, error) {
+	if maintainer == nil || *maintainer == (debianpkg.PackageMaintainer{}) {
+		return sql.NullInt64{}, nil
+	}
+	if id, ok := b.maintainers[*maintainer]; ok {
+		return id, nil
+	}
+
+	err := b.exec(ctx, "INSERT INTO maintainers (name, email) VALUES (?, ?) ON CONFLICT (name, email) DO NOTHING",
+		maintainer.Name, maintainer.Email)
+	if err != nil {
+		return sql.NullInt64{}, errors.Wrap(err, "failed to insert maintainer")
+	}
+
+	var id sql.NullInt64
+	err = b.queryRow(ctx, "SELECT id FROM maintainers WHERE name=? AND email=?",
+		[]any{maintainer.Name, maintainer.Email}, &id)
+	if err != nil {
+		return sql.NullInt64{}, errors.Wrap(err, "failed to get maintainer")
+	}
+	b.maintainers[*maintainer] = id
+
+	return id, nil
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+)
+
+// generatePackages returns n packages looking like the ones of an
+// archive, with relations and extra fields
+func generatePackages(n int) []*debianpkg.PackageInfo {
+	maintainers := []*debianpkg.PackageMaintainer{
+		{Name: "Ubuntu Developers", Email: "ubuntu-devel-discuss@lists.ubuntu.com"},
+		{Name: "Debian Med Packaging Team", Email: "debian-med-packaging@lists.alioth.debian.org"},
+	}
+
+	packages := make([]*debianpkg.PackageInfo, n)
+	for i := range packages {
+		name := fmt.Sprintf("package%v", i)
+		packages[i] = &debianpkg.PackageInfo{
+			Name:          name,
+			Version:       "1.0-1ubuntu1",
+			Component:     "main",
+			Suite:         "noble",
+			Architecture:  "amd64",
+			Source:        name,
+			Section:       "utils",
+			Maintainer:    maintainers[i%len(maintainers)],
+			SHA256:        "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			Size:          1000 + i,
+			InstalledSize: 10 + i,
+			FileName:      fmt.Sprintf("pool/main/p/%v/%v_1.0-1ubuntu1_amd64.deb", name, name),
+			Depends:       []string{"libc6 (>= 2.34)", "libssl3t64 (>= 3.0.0)", "debconf (>= 0.5) | debconf-2.0", "zlib1g"},
+			Recommends:    []string{"ca-certificates"},
+			Provides:      []string{fmt.Sprintf("virtual%v", i%10)},
+			Priority:      "optional",
+			Description:   "generated package\n This package was generated for a test.",
+			Extra:         map[string]string{"Origin": "Ubuntu", "Bugs": "https://bugs.launchpad.net/ubuntu/+filebug"},
+		}
+	}
+
+	return packages
+}
+
+func TestInsertOptions(t *testing.T) {
+	packages := generatePackages(10)
+	// more relations than the parameters of a statement
+	for i := 0; i < 200; i++ {
+		packages[0].Suggests = append(packages[0].Suggests, fmt.Sprintf("suggested%v", i))
+	}
+
+	for _, options := range []InsertOptions{
+		{},
+		{PrepareStatements: true},
+		{MultiRowValues: true},
+		{Tune: true},
+		DefaultInsertOptions,
+	} {
+		t.Run(fmt.Sprintf("%+v", options), func(t *testing.T) {
+			db, err := NewConn("sqlite3", path.Join(t.TempDir(), "test.sqlite"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			db.InsertOptions = options
+
+			insertPackages(t, db, packages...)
+			// and again, replacing them
+			insertPackages(t, db, packages...)
+
+			for _, pkg := range packages {
+				got, err := db.GetPackage(context.Background(), pkg.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != 1 || !reflect.DeepEqual(got[0], pkg) {
+					t.Errorf("expected %+v, got %+v", pkg, got)
+				}
+			}
+
+			rows, err := db.RowCounts(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rows["maintainers"] != 2 || rows["relations"] != 10*7+200 {
+				t.Errorf("unexpected row counts %v", rows)
+			}
+		})
+	}
+}
+
+func TestTuneRestoresSettings(t *testing.T) {
+	db, err := NewConn("sqlite3", path.Join(t.TempDir(), "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.InsertOptions = InsertOptions{Tune: true}
+	// the batch gets the connection used below
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("PRAGMA cache_size=-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// FULL, the default of go-sqlite3 is NORMAL
+	_, err = db.Exec("PRAGMA synchronous=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertPackages(t, db, generatePackages(10)...)
+
+	var cacheSize, synchronous int
+	err = db.QueryRow("PRAGMA cache_size").Scan(&cacheSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cacheSize != -1234 {
+		t.Errorf("expected the cache size of the connection to be restored, got %v", cacheSize)
+	}
+	err = db.QueryRow("PRAGMA synchronous").Scan(&synchronous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synchronous != 2 {
+		t.Errorf("expected synchronous to be restored, got %v", synchronous)
+	}
+}
+
+// BenchmarkInsertPackages compares the insert options, eg.:
+//
+//	go test -run '^$' -bench InsertPackages ./pkg/database
+func BenchmarkInsertPackages(b *testing.B) {
+	packages := generatePackages(1000)
+
+	for _, bench := range []struct {
+		name    string
+		options InsertOptions
+	}{
+		{"baseline", InsertOptions{}},
+		{"prepared", InsertOptions{PrepareStatements: true}},
+		{"prepared+multi-row", InsertOptions{PrepareStatements: true, MultiRowValues: true}},
+		{"prepared+tune", InsertOptions{PrepareStatements: true, Tune: true}},
+		{"default", DefaultInsertOptions},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			db, err := NewConn("sqlite3", path.Join(b.TempDir(), "bench.sqlite"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			db.InsertOptions = bench.options
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writer, err := db.Begin(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, pkg := range packages {
+					err = writer.InsertPackage(context.Background(), pkg)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				err = writer.Commit()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(packages))/b.Elapsed().Seconds(), "packages/s")
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dialect holds what differs between the SQL databases supported
+type dialect struct {
+	// setup are the statements run when connecting
+	setup []string
+	// numberedPlaceholders is true if the placeholders are $1, $2...
+	// instead of ?
+	numberedPlaceholders bool
+	// sizeQuery returns the size of the database in bytes
+	sizeQuery string
+	// lockSchema, if not empty, locks the schema_version table until
+	// the end of the transaction
+	lockSchema string
+	// serialPrimaryKey is the type of an auto-incremented primary key
+	serialPrimaryKey string
+	// params are added to the data source
+	params string
+	// singleWriter is true if only one transaction can write at a time
+	singleWriter bool
+	// tune are the settings of a connection speeding up the imports
+	tune []setting
+}
+
+// setting is a setting of a connection, read with get and changed by
+// formatting set with its value
+type setting struct {
+	get   string
+	set   string
+	value string
+}
+
+var dialects = map[string]*dialect{
+	"sqlite3": {
+		setup: []string{
+			// don't block reads
+			// see https://www.sqlite.org/wal.html
+			"PRAGMA journal_mode=WAL",
+		},
+		sizeQuery:        "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()",
+		serialPrimaryKey: "INTEGER PRIMARY KEY",
+		// foreign keys are disabled by default, on each connection,
+		// and the statements outside of the writers wait for them
+		// instead of failing with SQLITE_BUSY
+		params:       "_foreign_keys=on&_busy_timeout=30000",
+		singleWriter: true,
+		tune: []setting{
+			// 64MiB instead of 2MiB
+			{"PRAGMA cache_size", "PRAGMA cache_size=%v", "-65536"},
+			// NORMAL with go-sqlite3, the database can't be corrupted
+			// in WAL mode but a power loss may roll back the last
+			// batches committed
+			{"PRAGMA synchronous", "PRAGMA synchronous=%v", "OFF"},
+		},
+	},
+	"postgres": {
+		numberedPlaceholders: true,
+		sizeQuery:            "SELECT pg_database_size(current_database())",
+		lockSchema:           "LOCK TABLE schema_version IN EXCLUSIVE MODE",
+		serialPrimaryKey:     "BIGSERIAL PRIMARY KEY",
+	},
+}
+
+// rebind rewrites the ? placeholders of a query for the dialect
+func (d *dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
+
+// dataSource adds the parameters of the dialect to a data source
+func (d *dialect) dataSource(dataSource string) string {
+	if d.params == "" {
+		return dataSource
+	}
+	if strings.Contains(dataSource, "?") {
+		return dataSource + "&" + d.params
+	}
+
+	return dataSource + "?" + d.params
+}
+
+// upsert returns a query inserting a row in table, replacing the
+// row with the same primary key
+func upsert(table string, columns []string, key []string) string {
+	quoted := make([]string, len(columns))
+	updates := make([]string, 0, len(columns))
+	for i, column := range columns {
+		quoted[i] = `"` + column + `"`
+		if !contains(key, column) {
+			updates = append(updates, quoted[i]+"=excluded."+quoted[i])
+		}
+	}
+
+	return "INSERT INTO " + table + " (" + strings.Join(quoted, ", ") + ") VALUES (" +
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ") ON CONFLICT (" +
+		`"` + strings.Join(key, `", "`) + `") DO UPDATE SET ` + strings.Join(updates, ", ")
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Driver returns the name of the driver to use for a database: postgres
+// for the postgres:// URLs, sqlite3 for anything else
+func Driver(dataSource string) string {
+	if strings.HasPrefix(dataSource, "postgres://") || strings.HasPrefix(dataSource, "postgresql://") {
+		return "postgres"
+	}
+
+	return "sqlite3"
+}
+
+// Redact hides the password of a database URL so that it can be logged
+func Redact(dataSource string) string {
+	if Driver(dataSource) != "postgres" {
+		return dataSource
+	}
+
+	u, err := url.Parse(dataSource)
+	if err != nil {
+		return "postgres://..."
+	}
+
+	return u.Redacted()
+}
+
+func getDialect(driver string) (*dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, errors.Errorf("unsupported database driver %q", driver)
+	}
+
+	return d, nil
+}
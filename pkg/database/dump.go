@@ -0,0 +1,241 @@
+package database
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+	"github.com/pkg/errors"
+)
+
+// Record is a line of a dump, either a package or the state of the
+// Release file of a pocket
+type Record struct {
+	// Archive is the name of the archive in the config of the server
+	Archive      string                 `json:"archive"`
+	Package      *debianpkg.PackageInfo `json:"package,omitempty"`
+	ReleaseState *ReleaseState          `json:"release-state,omitempty"`
+}
+
+// DumpWriter writes a dump: gzip-compressed JSON Lines, one Record per
+// line
+type DumpWriter struct {
+	gz      *gzip.Writer
+	encoder *json.Encoder
+}
+
+// NewDumpWriter starts a dump in w, it's only complete once the
+// DumpWriter is closed
+func NewDumpWriter(w io.Writer) *DumpWriter {
+	gz := gzip.NewWriter(w)
+
+	return &DumpWriter{
+		gz:      gz,
+		encoder: json.NewEncoder(gz),
+	}
+}
+
+// Write adds a record to the dump
+func (d *DumpWriter) Write(record *Record) error {
+	return d.encoder.Encode(record)
+}
+
+// Close ends the dump, the underlying writer isn't closed
+func (d *DumpWriter) Close() error {
+	return d.gz.Close()
+}
+
+// DumpReader reads the records of a dump written by a DumpWriter
+type DumpReader struct {
+	gz      *gzip.Reader
+	decoder *json.Decoder
+}
+
+// NewDumpReader starts reading a dump from r
+func NewDumpReader(r io.Reader) (*DumpReader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "not a dump")
+	}
+
+	return &DumpReader{
+		gz:      gz,
+		decoder: json.NewDecoder(gz),
+	}, nil
+}
+
+// Read returns the next record, io.EOF at the end of the dump
+func (d *DumpReader) Read() (*Record, error) {
+	record := new(Record)
+	err := d.decoder.Decode(record)
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid record")
+	}
+
+	return record, nil
+}
+
+// Close releases the reader, the underlying reader isn't closed
+func (d *DumpReader) Close() error {
+	return d.gz.Close()
+}
+
+// MatchSuite returns true if the pocket (eg. "noble-updates") is one of
+// suites, or if suites is empty
+func MatchSuite(suites []string, pocket string) bool {
+	if len(suites) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(suites, func(suite string) bool {
+		return pocket == suite || strings.HasPrefix(pocket, suite+"-")
+	})
+}
+
+// Export writes the packages of a store, then the states of the Release
+// files, in a dump. Only the suites listed are exported, all of them if
+// empty. Returns the number of packages exported.
+func Export(ctx context.Context, w *DumpWriter, archive string, store Store, suites []string) (int, error) {
+	n := 0
+	err := store.ForEachPackage(ctx, func(pkgInfo *debianpkg.PackageInfo) error {
+		if !MatchSuite(suites, pkgInfo.Suite) {
+			return nil
+		}
+
+		n++
+		return w.Write(&Record{Archive: archive, Package: pkgInfo})
+	})
+	if err != nil {
+		return n, errors.Wrap(err, "failed to export packages")
+	}
+
+	// the states come last: an import interrupted before the end
+	// doesn't prevent the next refresh from downloading the pockets
+	states, err := store.GetReleaseStates(ctx, archive)
+	if err != nil {
+		return n, errors.Wrap(err, "failed to export release states")
+	}
+	for _, state := range states {
+		if !MatchSuite(suites, state.Pocket) {
+			continue
+		}
+
+		err = w.Write(&Record{Archive: archive, ReleaseState: state})
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// importBatchSize is the number of packages imported per transaction
+const importBatchSize = 10000
+
+// Import loads a dump in the stores, by archive name. The records of the
+// other archives and of the suites not listed are skipped, no suite is
+// skipped if suites is empty. The packages already in the stores are
+// replaced by the ones of the dump, the others are kept. Returns the
+// number of packages imported by archive.
+func Import(ctx context.Context, r *DumpReader, stores map[string]Store, suites []string) (map[string]int, error) {
+	imported := make(map[string]int)
+	writers := make(map[string]Writer)
+	pending := make(map[string]int)
+
+	rollback := func() {
+		for _, writer := range writers {
+			writer.Rollback()
+		}
+	}
+	commit := func(archive string) error {
+		writer, ok := writers[archive]
+		if !ok {
+			return nil
+		}
+		delete(writers, archive)
+
+		err := writer.Commit()
+		if err != nil {
+			return errors.Wrapf(err, "failed to import packages of %v", archive)
+		}
+		imported[archive] += pending[archive]
+		pending[archive] = 0
+
+		return nil
+	}
+
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			rollback()
+			return imported, err
+		}
+
+		store, ok := stores[record.Archive]
+		if !ok {
+			continue
+		}
+
+		switch {
+		case record.Package != nil:
+			if !MatchSuite(suites, record.Package.Suite) {
+				continue
+			}
+
+			writer, ok := writers[record.Archive]
+			if !ok {
+				writer, err = store.Begin(ctx)
+				if err != nil {
+					rollback()
+					return imported, err
+				}
+				writers[record.Archive] = writer
+			}
+
+			err = writer.InsertPackage(ctx, record.Package)
+			if err != nil {
+				rollback()
+				return imported, errors.Wrapf(err, "failed to import package %v", record.Package.Name)
+			}
+			pending[record.Archive]++
+			if pending[record.Archive] == importBatchSize {
+				err = commit(record.Archive)
+			}
+		case record.ReleaseState != nil:
+			if !MatchSuite(suites, record.ReleaseState.Pocket) {
+				continue
+			}
+
+			// the packages of the pocket are committed first
+			err = commit(record.Archive)
+			if err == nil {
+				record.ReleaseState.Archive = record.Archive
+				err = store.SetReleaseState(ctx, record.ReleaseState)
+			}
+		}
+		if err != nil {
+			rollback()
+			return imported, err
+		}
+	}
+
+	for archive := range writers {
+		err := commit(archive)
+		if err != nil {
+			rollback()
+			return imported, err
+		}
+	}
+
+	return imported, nil
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+
+	noble := generatePackages(3)
+	jammy := generatePackages(2)
+	for _, pkg := range jammy {
+		pkg.Suite = "jammy"
+		pkg.Pocket = "-updates"
+	}
+	source := NewMemory()
+	insertPackages(t, source, append(noble, jammy...)...)
+	for _, pocket := range []string{"noble", "noble-updates", "jammy-updates"} {
+		err := source.SetReleaseState(ctx, &ReleaseState{Archive: "ubuntu", Pocket: pocket, URL: "http://archive.ubuntu.com/ubuntu/dists/" + pocket + "/InRelease", ETag: `"1"`})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dump := new(bytes.Buffer)
+	w := NewDumpWriter(dump)
+	n, err := Export(ctx, w, "ubuntu", source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("expected 5 packages exported, got %v", n)
+	}
+	_, err = Export(ctx, w, "ppa", source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forEachStore(t, func(t *testing.T, db Store) {
+		r, err := NewDumpReader(bytes.NewReader(dump.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		imported, err := Import(ctx, r, map[string]Store{"ubuntu": db}, []string{"noble"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(imported, map[string]int{"ubuntu": 3}) {
+			t.Errorf("unexpected imported packages %v", imported)
+		}
+
+		// exporting again gives the packages of noble only
+		again := new(bytes.Buffer)
+		w := NewDumpWriter(again)
+		_, err = Export(ctx, w, "ubuntu", db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+
+		r, err = NewDumpReader(again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packages := make(map[string]*debianpkg.PackageInfo)
+		pockets := make([]string, 0)
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record.Package != nil {
+				packages[record.Package.Name] = record.Package
+			}
+			if record.ReleaseState != nil {
+				pockets = append(pockets, record.ReleaseState.Pocket)
+			}
+		}
+
+		if len(packages) != len(noble) {
+			t.Errorf("expected %v packages, got %v", len(noble), len(packages))
+		}
+		for _, pkg := range noble {
+			if !reflect.DeepEqual(packages[pkg.Name], pkg) {
+				t.Errorf("expected %+v, got %+v", pkg, packages[pkg.Name])
+			}
+		}
+		if !reflect.DeepEqual(pockets, []string{"noble", "noble-updates"}) {
+			t.Errorf("unexpected release states %v", pockets)
+		}
+	})
+}
+
+func TestMatchSuite(t *testing.T) {
+	tests := []struct {
+		suites   []string
+		pocket   string
+		expected bool
+	}{
+		{nil, "noble", true},
+		{[]string{"noble"}, "noble", true},
+		{[]string{"noble"}, "noble-updates", true},
+		{[]string{"noble"}, "jammy", false},
+		{[]string{"jammy", "noble"}, "noble-security", true},
+		{[]string{"noble"}, "noblest", false},
+	}
+
+	for _, test := range tests {
+		if got := MatchSuite(test.suites, test.pocket); got != test.expected {
+			t.Errorf("MatchSuite(%v, %v): expected %v, got %v", test.suites, test.pocket, test.expected, got)
+		}
+	}
+}
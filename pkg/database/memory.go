@@ -0,0 +1,360 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+)
+
+// packageKey identifies a package in an archive, like the primary key
+// of the packages table
+type packageKey struct {
+	name         string
+	component    string
+	suite        string
+	pocket       string
+	architecture string
+}
+
+func keyOf(pkgInfo *debianpkg.PackageInfo) packageKey {
+	return packageKey{
+		name:         pkgInfo.Name,
+		component:    pkgInfo.Component,
+		suite:        pkgInfo.Suite,
+		pocket:       pkgInfo.Pocket,
+		architecture: pkgInfo.Architecture,
+	}
+}
+
+// stateKey identifies a release state
+type stateKey struct {
+	archive string
+	pocket  string
+}
+
+// Memory is a Store keeping everything in memory, nothing is persisted
+type Memory struct {
+	mutex    sync.RWMutex
+	packages map[string]map[packageKey]*debianpkg.PackageInfo
+	states   map[stateKey]ReleaseState
+}
+
+// NewMemory returns an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		packages: make(map[string]map[packageKey]*debianpkg.PackageInfo),
+		states:   make(map[stateKey]ReleaseState),
+	}
+}
+
+// Begin starts a Writer
+func (m *Memory) Begin(ctx context.Context) (Writer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &memoryWriter{memory: m}, nil
+}
+
+// memoryWriter keeps the packages until they are committed
+type memoryWriter struct {
+	memory *Memory
+
+	mutex   sync.Mutex
+	pending []*debianpkg.PackageInfo
+	done    bool
+}
+
+// InsertPackage adds a package to the writer
+func (w *memoryWriter) InsertPackage(ctx context.Context, pkgInfo *debianpkg.PackageInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.done {
+		return ErrWriterClosed
+	}
+	pkgCopy := *pkgInfo
+	// like with the SQL databases, the maintainer is never nil
+	if pkgCopy.Maintainer == nil {
+		pkgCopy.Maintainer = new(debianpkg.PackageMaintainer)
+	}
+	w.pending = append(w.pending, &pkgCopy)
+
+	return nil
+}
+
+// Commit adds the packages to the store
+func (w *memoryWriter) Commit() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.done {
+		return ErrWriterClosed
+	}
+	w.done = true
+
+	m := w.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, pkgInfo := range w.pending {
+		byKey, ok := m.packages[pkgInfo.Name]
+		if !ok {
+			byKey = make(map[packageKey]*debianpkg.PackageInfo)
+			m.packages[pkgInfo.Name] = byKey
+		}
+		byKey[keyOf(pkgInfo)] = pkgInfo
+	}
+	w.pending = nil
+
+	return nil
+}
+
+// Rollback discards the packages
+func (w *memoryWriter) Rollback() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.done = true
+	w.pending = nil
+
+	return nil
+}
+
+// GetPackage returns the package in every pocket, component and
+// architecture, sorted by pocket
+func (m *Memory) GetPackage(ctx context.Context, pkgName string) ([]*debianpkg.PackageInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	pkgInfo := make([]*debianpkg.PackageInfo, 0, len(m.packages[pkgName]))
+	for _, info := range m.packages[pkgName] {
+		infoCopy := *info
+		pkgInfo = append(pkgInfo, &infoCopy)
+	}
+
+	sort.Slice(pkgInfo, func(i, j int) bool {
+		a, b := keyOf(pkgInfo[i]), keyOf(pkgInfo[j])
+		if a.suite+a.pocket != b.suite+b.pocket {
+			return a.suite+a.pocket < b.suite+b.pocket
+		}
+		if a.component != b.component {
+			return a.component < b.component
+		}
+		return a.architecture < b.architecture
+	})
+
+	return pkgInfo, nil
+}
+
+// ForEachPackage calls fn with every package, sorted by name, until it
+// returns an error. The packages are those of the store when it's
+// called.
+func (m *Memory) ForEachPackage(ctx context.Context, fn func(*debianpkg.PackageInfo) error) error {
+	m.mutex.RLock()
+	names := make([]string, 0, len(m.packages))
+	for name := range m.packages {
+		names = append(names, name)
+	}
+	packages := make(map[string][]*debianpkg.PackageInfo, len(m.packages))
+	for name, byKey := range m.packages {
+		for _, info := range byKey {
+			// the packages are never modified once committed
+			packages[name] = append(packages[name], info)
+		}
+	}
+	m.mutex.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, info := range packages[name] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			infoCopy := *info
+			err := fn(&infoCopy)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetProviders returns the packages providing a virtual package
+func (m *Memory) GetProviders(ctx context.Context, virtualName string) ([]*debianpkg.Provider, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	providers := make([]*debianpkg.Provider, 0)
+	for _, byKey := range m.packages {
+		for _, info := range byKey {
+			for _, provides := range info.Provides {
+				r := parseRelation(provides)
+				if r.name != virtualName {
+					continue
+				}
+				providers = append(providers, &debianpkg.Provider{
+					Name:            info.Name,
+					Version:         info.Version,
+					Component:       info.Component,
+					Suite:           info.Suite,
+					Pocket:          info.Pocket,
+					Architecture:    info.Architecture,
+					ProvidedVersion: r.version,
+				})
+			}
+		}
+	}
+
+	sort.Slice(providers, func(i, j int) bool {
+		a, b := providers[i], providers[j]
+		if a.Suite+a.Pocket != b.Suite+b.Pocket {
+			return a.Suite+a.Pocket < b.Suite+b.Pocket
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Component != b.Component {
+			return a.Component < b.Component
+		}
+		return a.Architecture < b.Architecture
+	})
+
+	return providers, nil
+}
+
+// SearchPackages returns the names of the packages starting with prefix
+func (m *Memory) SearchPackages(ctx context.Context, prefix string, limit int) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	names := make([]string, 0)
+	for name := range m.packages {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	return names, nil
+}
+
+// CountPackagesPerPocket returns the number of packages in each pocket
+func (m *Memory) CountPackagesPerPocket(ctx context.Context) (map[string]int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	counts := make(map[string]int64)
+	for _, byKey := range m.packages {
+		for key := range byKey {
+			counts[key.suite+key.pocket]++
+		}
+	}
+
+	return counts, nil
+}
+
+// DeletePocket removes the packages of a pocket and its release state
+// in archive
+func (m *Memory) DeletePocket(ctx context.Context, archive, pocket string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for name, byKey := range m.packages {
+		for key := range byKey {
+			if key.suite+key.pocket == pocket {
+				delete(byKey, key)
+			}
+		}
+		if len(byKey) == 0 {
+			delete(m.packages, name)
+		}
+	}
+	delete(m.states, stateKey{archive, pocket})
+
+	return nil
+}
+
+// GetReleaseState returns the state of the Release file of the pocket of
+// archive, nil if unknown
+func (m *Memory) GetReleaseState(ctx context.Context, archive, pocket string) (*ReleaseState, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	state, ok := m.states[stateKey{archive, pocket}]
+	if !ok {
+		return nil, nil
+	}
+
+	return &state, nil
+}
+
+// GetReleaseStates returns the state of the Release file of every
+// pocket of archive, sorted by pocket
+func (m *Memory) GetReleaseStates(ctx context.Context, archive string) ([]*ReleaseState, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	states := make([]*ReleaseState, 0)
+	for key, state := range m.states {
+		if key.archive != archive {
+			continue
+		}
+		stateCopy := state
+		states = append(states, &stateCopy)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Pocket < states[j].Pocket })
+
+	return states, nil
+}
+
+// SetReleaseState saves the state of the Release file of a pocket
+func (m *Memory) SetReleaseState(ctx context.Context, state *ReleaseState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.states[stateKey{state.Archive, state.Pocket}] = *state
+
+	return nil
+}
+
+// Size is always 0, the memory used isn't tracked
+func (m *Memory) Size(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+// RowCounts returns the number of packages and release states, like
+// the tables of a SQL database
+func (m *Memory) RowCounts(ctx context.Context) (map[string]int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var packages int64
+	for _, byKey := range m.packages {
+		packages += int64(len(byKey))
+	}
+
+	return map[string]int64{
+		"packages":      packages,
+		"release_state": int64(len(m.states)),
+	}, nil
+}
+
+// Close does nothing, the packages are kept until the store is garbage
+// collected
+func (m *Memory) Close() error {
+	return nil
+}
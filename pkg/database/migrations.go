@@ -0,0 +1,310 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// migration upgrades the schema by one version
+type migration struct {
+	description string
+	up          func(ctx context.Context, tx *sql.Tx, d *dialect) error
+}
+
+// migrations upgrade the schema, migrations[i] going from version i to
+// version i+1. They are only ever appended: a released migration must
+// not change.
+var migrations = []migration{
+	{
+		// the databases created before the schema was versioned already
+		// have these tables
+		description: "create the packages and release_state tables",
+		up: execAll(
+			`CREATE TABLE IF NOT EXISTS packages (
+				"name" TEXT NOT NULL,
+				"version" TEXT NOT NULL,
+				"component" TEXT NOT NULL,
+				"suite" TEXT NOT NULL,
+				"pocket" TEXT NOT NULL,
+				"architecture" TEXT NOT NULL,
+				"source" TEXT NULL,
+				"section" TEXT NULL,
+				"maintainer_name" TEXT NULL,
+				"maintainer_email" TEXT NULL,
+				"sha256" TEXT NOT NULL,
+				"size" BIGINT NOT NULL,
+				"install_size" BIGINT NULL,
+				"file_name" TEXT NOT NULL,
+				"depends" TEXT NULL,
+				"pre_depends" TEXT NULL,
+				"replace" TEXT NULL,
+				"conflicts" TEXT NULL,
+				"suggests" TEXT NULL,
+				"description" TEXT NULL,
+				PRIMARY KEY ("name", "component", "suite", "pocket", "architecture")
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_name ON packages (name)`,
+			`CREATE TABLE IF NOT EXISTS release_state (
+				"pocket" TEXT NOT NULL,
+				"url" TEXT NOT NULL,
+				"etag" TEXT NULL,
+				"last_modified" TEXT NULL,
+				PRIMARY KEY ("pocket")
+			)`,
+		),
+	},
+	{
+		description: "move the maintainers, files and relations to their own tables",
+		up:          normalizePackages,
+	},
+	{
+		// the packages imported before are only completed when their
+		// index is imported again, on the first refresh after a restart
+		description: "add the other fields of the packages",
+		up: func(ctx context.Context, tx *sql.Tx, d *dialect) error {
+			return execAll(
+				`ALTER TABLE packages ADD COLUMN "priority" TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE packages ADD COLUMN "multi_arch" TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE packages ADD COLUMN "homepage" TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE packages ADD COLUMN "original_maintainer_id" BIGINT NULL REFERENCES maintainers ("id")`,
+				`ALTER TABLE packages ADD COLUMN "description_md5" TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE packages ADD COLUMN "phased_update_percentage" INTEGER NULL`,
+				`ALTER TABLE files ADD COLUMN "md5sum" TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE files ADD COLUMN "sha1" TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE files ADD COLUMN "sha512" TEXT NOT NULL DEFAULT ''`,
+				`CREATE TABLE extra_fields (
+					"package_id" BIGINT NOT NULL REFERENCES packages ("id") ON DELETE CASCADE,
+					"field" TEXT NOT NULL,
+					"value" TEXT NOT NULL,
+					PRIMARY KEY ("package_id", "field")
+				)`,
+			)(ctx, tx, d)
+		},
+	},
+	{
+		// the states can't be attributed to an archive, the InRelease
+		// files are downloaded again on the first refresh
+		description: "key the release states by archive",
+		up: execAll(
+			"DROP TABLE release_state",
+			`CREATE TABLE release_state (
+				"archive" TEXT NOT NULL,
+				"pocket" TEXT NOT NULL,
+				"url" TEXT NOT NULL,
+				"etag" TEXT NOT NULL,
+				"last_modified" TEXT NOT NULL,
+				PRIMARY KEY ("archive", "pocket")
+			)`,
+		),
+	},
+	{
+		// known again once a newer Release file is accepted
+		description: "save the date of the Release files",
+		up:          execAll(`ALTER TABLE release_state ADD COLUMN "date" TEXT NOT NULL DEFAULT ''`),
+	},
+}
+
+// SchemaVersion is the version of the schema this version of the
+// package works with
+var SchemaVersion = len(migrations)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// version of rmadison
+var ErrSchemaTooNew = errors.New("database schema is newer than supported")
+
+// execAll returns a migration running the statements in order
+func execAll(statements ...string) func(context.Context, *sql.Tx, *dialect) error {
+	return func(ctx context.Context, tx *sql.Tx, d *dialect) error {
+		for _, statement := range statements {
+			_, err := tx.ExecContext(ctx, statement)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// migrate upgrades the schema of the database to SchemaVersion, all in
+// one transaction
+func (db *DB) migrate(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version ("version" INTEGER NOT NULL)`)
+	if err != nil {
+		return errors.Wrap(err, "failed to create schema_version table")
+	}
+
+	// don't let another server migrate the same database at the same
+	// time
+	if db.dialect.lockSchema != "" {
+		_, err = tx.ExecContext(ctx, db.dialect.lockSchema)
+		if err != nil {
+			return errors.Wrap(err, "failed to lock schema_version table")
+		}
+	}
+
+	version := 0
+	err = tx.QueryRowContext(ctx, "SELECT version FROM schema_version").Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(err, "failed to read schema version")
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_version VALUES (0)")
+		if err != nil {
+			return errors.Wrap(err, "failed to initialize schema version")
+		}
+	}
+
+	if version > SchemaVersion {
+		return errors.Wrapf(ErrSchemaTooNew, "version %v, at most %v supported", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return nil
+	}
+
+	for i := version; i < SchemaVersion; i++ {
+		log.Infof("migrating database schema to version %v: %v", i+1, migrations[i].description)
+		err = migrations[i].up(ctx, tx, db.dialect)
+		if err != nil {
+			return errors.Wrapf(err, "failed to migrate database schema to version %v", i+1)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, db.dialect.rebind("UPDATE schema_version SET version=?"), SchemaVersion)
+	if err != nil {
+		return errors.Wrap(err, "failed to update schema version")
+	}
+
+	return tx.Commit()
+}
+
+// normalizePackages moves the maintainers, the files and the relations
+// of the packages to their own tables. The relations were joined with
+// ", " in a single column.
+func normalizePackages(ctx context.Context, tx *sql.Tx, d *dialect) error {
+	err := execAll(
+		`CREATE TABLE maintainers (
+			"id" `+d.serialPrimaryKey+`,
+			"name" TEXT NOT NULL,
+			"email" TEXT NOT NULL,
+			UNIQUE ("name", "email")
+		)`,
+		`CREATE TABLE packages_v2 (
+			"id" `+d.serialPrimaryKey+`,
+			"name" TEXT NOT NULL,
+			"version" TEXT NOT NULL,
+			"component" TEXT NOT NULL,
+			"suite" TEXT NOT NULL,
+			"pocket" TEXT NOT NULL,
+			"architecture" TEXT NOT NULL,
+			"source" TEXT NOT NULL,
+			"section" TEXT NOT NULL,
+			"maintainer_id" BIGINT NULL REFERENCES maintainers ("id"),
+			"installed_size" BIGINT NOT NULL,
+			"description" TEXT NOT NULL,
+			UNIQUE ("name", "component", "suite", "pocket", "architecture")
+		)`,
+		`CREATE TABLE files (
+			"package_id" BIGINT NOT NULL PRIMARY KEY REFERENCES packages_v2 ("id") ON DELETE CASCADE,
+			"file_name" TEXT NOT NULL,
+			"size" BIGINT NOT NULL,
+			"sha256" TEXT NOT NULL
+		)`,
+		`CREATE TABLE relations (
+			"package_id" BIGINT NOT NULL REFERENCES packages_v2 ("id") ON DELETE CASCADE,
+			"field" TEXT NOT NULL,
+			"ordinal" INTEGER NOT NULL,
+			"alternative" INTEGER NOT NULL,
+			"name" TEXT NOT NULL,
+			"arch_qualifier" TEXT NOT NULL,
+			"operator" TEXT NOT NULL,
+			"version" TEXT NOT NULL,
+			"restrictions" TEXT NOT NULL,
+			PRIMARY KEY ("package_id", "field", "ordinal", "alternative")
+		)`,
+		`CREATE INDEX idx_relations_name ON relations ("field", "name")`,
+		`INSERT INTO maintainers (name, email)
+			SELECT DISTINCT COALESCE(maintainer_name, ''), COALESCE(maintainer_email, '') FROM packages
+			WHERE COALESCE(maintainer_name, '') != '' OR COALESCE(maintainer_email, '') != ''`,
+		`INSERT INTO packages_v2
+			(name, version, component, suite, pocket, architecture, source, section, maintainer_id, installed_size, description)
+			SELECT p.name, p.version, p.component, p.suite, p.pocket, p.architecture,
+				COALESCE(p.source, ''), COALESCE(p.section, ''), m.id,
+				COALESCE(CAST(p.install_size AS BIGINT), 0), COALESCE(p.description, '')
+			FROM packages p LEFT JOIN maintainers m
+				ON m.name = COALESCE(p.maintainer_name, '') AND m.email = COALESCE(p.maintainer_email, '')`,
+		`INSERT INTO files (package_id, file_name, size, sha256)
+			SELECT n.id, p.file_name, p.size, p.sha256 FROM packages p JOIN packages_v2 n
+				ON n.name = p.name AND n.component = p.component AND n.suite = p.suite
+				AND n.pocket = p.pocket AND n.architecture = p.architecture`,
+	)(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+
+	// the relations are split in Go, a page at a time since a
+	// connection can't run queries while reading rows with every driver
+	type packageRelations struct {
+		id     int64
+		fields [5]sql.NullString
+	}
+	lastID := int64(0)
+	for {
+		rows, err := tx.QueryContext(ctx, d.rebind(`SELECT n.id, p.depends, p.pre_depends, p."replace", p.conflicts, p.suggests
+			FROM packages p JOIN packages_v2 n
+				ON n.name = p.name AND n.component = p.component AND n.suite = p.suite
+				AND n.pocket = p.pocket AND n.architecture = p.architecture
+			WHERE n.id > ? ORDER BY n.id LIMIT 1000`), lastID)
+		if err != nil {
+			return err
+		}
+
+		page := make([]packageRelations, 0, 1000)
+		for rows.Next() {
+			var r packageRelations
+			err = rows.Scan(&r.id, &r.fields[0], &r.fields[1], &r.fields[2], &r.fields[3], &r.fields[4])
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			page = append(page, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		relations := make([][]any, 0)
+		for _, r := range page {
+			for i, field := range []string{"Depends", "Pre-Depends", "Replaces", "Conflicts", "Suggests"} {
+				relations = append(relations, relationRows(r.id, field, strings.Split(r.fields[i].String, ", "))...)
+			}
+		}
+		b := &batch{dialect: d, options: InsertOptions{MultiRowValues: true}, tx: tx}
+		err = b.insertRows(ctx, "relations", relationsColumns, relations)
+		if err != nil {
+			return err
+		}
+		lastID = page[len(page)-1].id
+	}
+
+	// the new table is only renamed once the old one is dropped, the
+	// constraints of a renamed table keep their names and would
+	// conflict with the new ones
+	return execAll(
+		"DROP TABLE packages",
+		"ALTER TABLE packages_v2 RENAME TO packages",
+	)(ctx, tx, d)
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+	"github.com/pkg/errors"
+)
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	var version int
+	err := db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return version
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "test.sqlite")
+
+	// the schema before it was versioned
+	rawdb, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE packages (
+			'name' VARCHAR(64) NOT NULL,
+			'version' VARCHAR(64) NOT NULL,
+			'component' VARCHAR(64) NOT NULL,
+			'suite' VARCHAR(64) NOT NULL,
+			'pocket' VARCHAR(64) NOT NULL,
+			'architecture' VARCHAR(10) NOT NULL,
+			'source' VARCHAR(64) NULL,
+			'section' VARCHAR(64) NULL,
+			'maintainer_name' VARCHAR(64) NULL,
+			'maintainer_email' VARCHAR(64) NULL,
+			'sha256' VARCHAR(65) NOT NULL,
+			'size' INTEGER NOT NULL,
+			'install_size' VARCHAR(64) NULL,
+			'file_name' VARCHAR(64) NOT NULL,
+			'depends' VARCHAR(200) NULL,
+			'pre_depends' VARCHAR(200) NULL,
+			'replace' VARCHAR(200) NULL,
+			'conflicts' VARCHAR(200) NULL,
+			'suggests' VARCHAR(200) NULL,
+			'description' VARCHAR(64) NULL,
+			PRIMARY KEY ('name', 'component', 'suite', 'pocket', 'architecture')
+		)`,
+		"CREATE INDEX idx_name ON packages (name)",
+		`INSERT INTO packages VALUES ('hello', '2.10-3', 'main', 'noble', '', 'amd64', '', 'devel', '', '', '',
+			52, 280, 'pool/main/h/hello/hello_2.10-3_amd64.deb', 'libc6 (>= 2.34)', '', '', '', '', 'example package')`,
+	} {
+		_, err = rawdb.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rawdb.Close()
+
+	db, err := NewConn("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if version := schemaVersion(t, db.DB); version != SchemaVersion {
+		t.Errorf("expected version %v, got %v", SchemaVersion, version)
+	}
+
+	packages, err := db.GetPackage(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 1 || packages[0].Version != "2.10-3" || packages[0].InstalledSize != 280 ||
+		packages[0].FileName != "pool/main/h/hello/hello_2.10-3_amd64.deb" || *packages[0].Maintainer != (debianpkg.PackageMaintainer{}) {
+		t.Fatalf("unexpected packages after migration: %+v", packages)
+	}
+	if !reflect.DeepEqual(packages[0].Depends, []string{"libc6 (>= 2.34)"}) || packages[0].PreDepends != nil {
+		t.Errorf("unexpected relations after migration: %q, %q", packages[0].Depends, packages[0].PreDepends)
+	}
+
+	// the foreign keys point to the new table
+	err = db.DeletePocket(context.Background(), "ubuntu", "noble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := db.RowCounts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["files"] != 0 || counts["relations"] != 0 {
+		t.Errorf("expected the files and relations to be deleted, got %v", counts)
+	}
+
+	// nothing to migrate the second time
+	db.Close()
+	db, err = NewConn("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "test.sqlite")
+
+	db, err := NewConn("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE schema_version SET version=?", SchemaVersion+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = NewConn("sqlite3", dbPath)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
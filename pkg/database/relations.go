@@ -0,0 +1,103 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+)
+
+// relationFields are the fields of a package stored in the relations
+// table
+var relationFields = []struct {
+	name   string
+	values func(*debianpkg.PackageInfo) *[]string
+}{
+	{"Depends", func(p *debianpkg.PackageInfo) *[]string { return &p.Depends }},
+	{"Pre-Depends", func(p *debianpkg.PackageInfo) *[]string { return &p.PreDepends }},
+	{"Replaces", func(p *debianpkg.PackageInfo) *[]string { return &p.Replaces }},
+	{"Conflicts", func(p *debianpkg.PackageInfo) *[]string { return &p.Conflicts }},
+	{"Suggests", func(p *debianpkg.PackageInfo) *[]string { return &p.Suggests }},
+	{"Provides", func(p *debianpkg.PackageInfo) *[]string { return &p.Provides }},
+	{"Recommends", func(p *debianpkg.PackageInfo) *[]string { return &p.Recommends }},
+	{"Breaks", func(p *debianpkg.PackageInfo) *[]string { return &p.Breaks }},
+	{"Enhances", func(p *debianpkg.PackageInfo) *[]string { return &p.Enhances }},
+	{"Built-Using", func(p *debianpkg.PackageInfo) *[]string { return &p.BuiltUsing }},
+	{"Task", func(p *debianpkg.PackageInfo) *[]string { return &p.Task }},
+}
+
+// relation is one alternative of a relationship between packages, eg.
+// "libc6:any (>= 2.34)" in "Depends: libc6:any (>= 2.34) | libc6-dev"
+type relation struct {
+	name          string
+	archQualifier string
+	operator      string
+	version       string
+	// restrictions are the architecture restrictions and build
+	// profiles, eg. "[amd64] <!nocheck>"
+	restrictions string
+}
+
+// parseRelation reads an alternative of a relationship
+func parseRelation(s string) relation {
+	s = strings.TrimSpace(s)
+
+	var r relation
+	end := strings.IndexAny(s, " \t([<")
+	if end < 0 {
+		end = len(s)
+	}
+	r.name, r.archQualifier, _ = strings.Cut(s[:end], ":")
+
+	rest := strings.TrimSpace(s[end:])
+	if strings.HasPrefix(rest, "(") {
+		constraint, after, _ := strings.Cut(rest[1:], ")")
+		constraint = strings.TrimSpace(constraint)
+		version := strings.TrimLeft(constraint, "<>=")
+		r.operator = constraint[:len(constraint)-len(version)]
+		r.version = strings.TrimSpace(version)
+		rest = strings.TrimSpace(after)
+	}
+	r.restrictions = rest
+
+	return r
+}
+
+func (r relation) String() string {
+	var b strings.Builder
+	b.WriteString(r.name)
+	if r.archQualifier != "" {
+		b.WriteString(":" + r.archQualifier)
+	}
+	if r.version != "" {
+		b.WriteString(" (")
+		if r.operator != "" {
+			b.WriteString(r.operator + " ")
+		}
+		b.WriteString(r.version + ")")
+	}
+	if r.restrictions != "" {
+		b.WriteString(" " + r.restrictions)
+	}
+
+	return b.String()
+}
+
+// relationRows returns the rows of the relations table for a field of
+// a package, one per alternative
+func relationRows(packageID int64, field string, values []string) [][]any {
+	rows := make([][]any, 0, len(values))
+	for ordinal, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+
+		for alternative, s := range strings.Split(value, "|") {
+			r := parseRelation(s)
+			rows = append(rows, []any{
+				packageID, field, ordinal, alternative, r.name, r.archQualifier, r.operator, r.version, r.restrictions,
+			})
+		}
+	}
+
+	return rows
+}
@@ -0,0 +1,34 @@
+package database
+
+import "testing"
+
+func TestParseRelation(t *testing.T) {
+	tests := []struct {
+		relation string
+		expected relation
+		// formatted is the relation written back, if different
+		formatted string
+	}{
+		{"libc6", relation{name: "libc6"}, ""},
+		{"libc6 (>= 2.34)", relation{name: "libc6", operator: ">=", version: "2.34"}, ""},
+		{"python3:any (<< 3.13)", relation{name: "python3", archQualifier: "any", operator: "<<", version: "3.13"}, ""},
+		{"debconf-2.0", relation{name: "debconf-2.0"}, ""},
+		{"foo (=1.0)", relation{name: "foo", operator: "=", version: "1.0"}, "foo (= 1.0)"},
+		{" bar [amd64] <!nocheck>", relation{name: "bar", restrictions: "[amd64] <!nocheck>"}, "bar [amd64] <!nocheck>"},
+	}
+
+	for _, test := range tests {
+		r := parseRelation(test.relation)
+		if r != test.expected {
+			t.Errorf("%q: expected %+v, got %+v", test.relation, test.expected, r)
+		}
+
+		formatted := test.formatted
+		if formatted == "" {
+			formatted = test.relation
+		}
+		if r.String() != formatted {
+			t.Errorf("%q: expected %q, got %q", test.relation, formatted, r.String())
+		}
+	}
+}
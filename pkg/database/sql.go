@@ -1,132 +1,327 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"strings"
+	"slices"
+	"time"
 
 	"github.com/gjolly/go-rmadison/pkg/debianpkg"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
+var log *zap.SugaredLogger
+
+func init() {
+	// Logger for the operations
+	logger, _ := zap.NewDevelopment()
+	log = logger.Sugar()
+}
+
+// SetLogger replaces the logger used by the package
+func SetLogger(logger *zap.SugaredLogger) {
+	log = logger
+}
+
 // DB is a package databse
 type DB struct {
 	*sql.DB
 
-	tableName   string
-	transaction *sql.Tx
+	// InsertOptions are used by the batches started after they are
+	// changed
+	InsertOptions InsertOptions
+
+	tableName string
+	dialect   *dialect
+	// writers holds a value per running Writer if the database only
+	// allows one writer at a time
+	writers chan struct{}
 }
 
-// NewConn initialize a connection to the DB
+// snapshot are the options of the transactions of the reads made of
+// several queries, so that they see a consistent state of the database
+var snapshot = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+var packagesColumns = []string{
+	"name",
+	"version",
+	"component",
+	"suite",
+	"pocket",
+	"architecture",
+	"source",
+	"section",
+	"maintainer_id",
+	"installed_size",
+	"description",
+	"priority",
+	"multi_arch",
+	"homepage",
+	"original_maintainer_id",
+	"description_md5",
+	"phased_update_percentage",
+}
+
+var packagesKey = []string{"name", "component", "suite", "pocket", "architecture"}
+
+// NewConn initialize a connection to the DB. driver is either sqlite3
+// or postgres, see Driver. The schema is migrated to SchemaVersion if
+// needed, ErrSchemaTooNew is returned if it's already newer.
 func NewConn(driver, path string) (*DB, error) {
-	rawdb, err := sql.Open(driver, path)
+	d, err := getDialect(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	rawdb, err := sql.Open(driver, d.dataSource(path))
 	if err != nil {
 		return nil, err
 	}
 	db := &DB{
-		rawdb,
-		"packages",
-		nil,
+		DB:            rawdb,
+		InsertOptions: DefaultInsertOptions,
+		tableName:     "packages",
+		dialect:       d,
+	}
+	if d.singleWriter {
+		db.writers = make(chan struct{}, 1)
 	}
 
-	err = db.setupDB(driver)
+	err = db.setupDB()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	err = db.createTableIfNeeded()
+	err = db.migrate(context.Background())
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
-func (db *DB) setupDB(driver string) error {
-	if driver == "sqlite3" {
-		// don't block reads
-		// see https://www.sqlite.org/wal.html
-		_, err := db.Exec("PRAGMA journal_mode=WAL")
-		return err
+func (db *DB) setupDB() error {
+	for _, query := range db.dialect.setup {
+		_, err := db.Exec(query)
+		if err != nil {
+			return errors.Wrap(err, "failed to set up DB")
+		}
 	}
 
 	return nil
 }
 
-func (db *DB) createTableIfNeeded() error {
-	res, err := db.Query("SELECT COUNT(name) FROM sqlite_master WHERE type='table' AND name=?", db.tableName)
-	if err != nil {
-		return errors.Wrap(err, "failed to get tables from DB")
+// ReleaseState is what we know about the last Release file
+// downloaded for a pocket
+type ReleaseState struct {
+	// Archive isn't in the dumps, their records have their own
+	Archive string `json:"-"`
+	Pocket  string `json:"pocket"`
+	// URL the Release file was downloaded from
+	URL string `json:"url"`
+	// ETag and LastModified are the headers of the response
+	ETag         string `json:"etag"`
+	LastModified string `json:"last-modified"`
+	// Date of the Release file, zero if unknown
+	Date time.Time `json:"date"`
+}
+
+// formatDate returns a date as RFC 3339 text, stored the same way by
+// every database, empty if zero
+func formatDate(date time.Time) string {
+	if date.IsZero() {
+		return ""
 	}
-	res.Next()
-	var n int
-	res.Scan(&n)
-	res.Close()
 
-	if n != 0 {
-		return nil
+	return date.UTC().Format(time.RFC3339)
+}
+
+// parseDate parses a date written by formatDate
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// GetReleaseState returns the state of the Release file of the pocket of
+// archive, nil if unknown
+func (db *DB) GetReleaseState(ctx context.Context, archive, pocket string) (*ReleaseState, error) {
+	state := &ReleaseState{Archive: archive, Pocket: pocket}
+
+	var date string
+	err := db.QueryRowContext(ctx, db.dialect.rebind("SELECT url, etag, last_modified, date FROM release_state WHERE archive=? AND pocket=?"),
+		archive, pocket).Scan(&state.URL, &state.ETag, &state.LastModified, &date)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
 	}
-	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	state.Date, err = parseDate(date)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse release date")
 	}
 
-	_, err = tx.Exec(`CREATE TABLE packages (
-		'name' VARCHAR(64) NOT NULL,
-		'version' VARCHAR(64) NOT NULL,
-		'component' VARCHAR(64) NOT NULL,
-		'suite' VARCHAR(64) NOT NULL,
-		'pocket' VARCHAR(64) NOT NULL,
-		'architecture' VARCHAR(10) NOT NULL,
-		'source' VARCHAR(64) NULL,
-		'section' VARCHAR(64) NULL,
-		'maintainer_name' VARCHAR(64) NULL,
-		'maintainer_email' VARCHAR(64) NULL,
-		'sha256' VARCHAR(65) NOT NULL,
-		'size' INTEGER NOT NULL,
-		'install_size' VARCHAR(64) NULL,
-		'file_name' VARCHAR(64) NOT NULL,
-		'depends' VARCHAR(200) NULL,
-		'pre_depends' VARCHAR(200) NULL,
-		'replace' VARCHAR(200) NULL,
-		'conflicts' VARCHAR(200) NULL,
-		'suggests' VARCHAR(200) NULL,
-		'description' VARCHAR(64) NULL,
-		PRIMARY KEY ('name', 'component', 'suite', 'pocket', 'architecture')
-	)`)
+	return state, nil
+}
+
+// GetReleaseStates returns the state of the Release file of every
+// pocket of archive, sorted by pocket
+func (db *DB) GetReleaseStates(ctx context.Context, archive string) ([]*ReleaseState, error) {
+	rows, err := db.QueryContext(ctx, db.dialect.rebind("SELECT pocket, url, etag, last_modified, date FROM release_state WHERE archive=? ORDER BY pocket"),
+		archive)
 	if err != nil {
-		tx.Rollback()
-		return errors.Wrap(err, "Failed to create tables in DB")
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make([]*ReleaseState, 0)
+	for rows.Next() {
+		state := &ReleaseState{Archive: archive}
+		var date string
+		err = rows.Scan(&state.Pocket, &state.URL, &state.ETag, &state.LastModified, &date)
+		if err != nil {
+			return nil, err
+		}
+		state.Date, err = parseDate(date)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse release date")
+		}
+		states = append(states, state)
 	}
 
-	_, err = tx.Exec("CREATE INDEX idx_name ON packages (name)")
+	return states, rows.Err()
+}
+
+// SetReleaseState saves the state of the Release file of a pocket
+func (db *DB) SetReleaseState(ctx context.Context, state *ReleaseState) error {
+	_, err := db.ExecContext(ctx, db.dialect.rebind(upsert("release_state",
+		[]string{"archive", "pocket", "url", "etag", "last_modified", "date"}, []string{"archive", "pocket"})),
+		state.Archive,
+		state.Pocket,
+		state.URL,
+		state.ETag,
+		state.LastModified,
+		formatDate(state.Date),
+	)
+
+	return err
+}
+
+// DeletePocket removes the packages of a pocket (eg. "jammy-updates")
+// and its release state in archive
+func (db *DB) DeletePocket(ctx context.Context, archive, pocket string) error {
+	_, err := db.ExecContext(ctx, db.dialect.rebind("DELETE FROM packages WHERE suite || pocket=?"), pocket)
 	if err != nil {
-		tx.Rollback()
-		return errors.Wrap(err, "failed to create index")
+		return err
 	}
 
-	return tx.Commit()
+	_, err = db.ExecContext(ctx, db.dialect.rebind("DELETE FROM release_state WHERE archive=? AND pocket=?"), archive, pocket)
+
+	return err
 }
 
+// packagesQuery selects the packages read by scanPackages
+const packagesQuery = `SELECT p.id, p.name, p.version, p.component, p.suite, p.pocket,
+		p.architecture, p.source, p.section, m.name, m.email, f.sha256, f.size, p.installed_size,
+		f.file_name, p.description, p.priority, p.multi_arch, p.homepage, om.name, om.email,
+		f.md5sum, f.sha1, f.sha512, p.description_md5, p.phased_update_percentage
+	FROM packages p
+	LEFT JOIN maintainers m ON m.id = p.maintainer_id
+	LEFT JOIN maintainers om ON om.id = p.original_maintainer_id
+	LEFT JOIN files f ON f.package_id = p.id`
+
+// packagesOrder sorts the packages like Memory.GetPackage
+const packagesOrder = " ORDER BY p.suite || p.pocket, p.component, p.architecture"
+
 // GetPackage from the db
-func (db *DB) GetPackage(pkgName string) ([]*debianpkg.PackageInfo, error) {
-	rows, err := db.Query("SELECT * FROM packages WHERE name=?", pkgName)
+func (db *DB) GetPackage(ctx context.Context, pkgName string) ([]*debianpkg.PackageInfo, error) {
+	tx, err := db.BeginTx(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	pkgInfo, _, err := db.getPackages(ctx, tx, "p.name=?", pkgName)
 	if err != nil {
 		return nil, err
 	}
+
+	return pkgInfo, nil
+}
+
+// ForEachPackage calls fn with every package, by ID, until it returns
+// an error. The packages are read from a snapshot of the database.
+func (db *DB) ForEachPackage(ctx context.Context, fn func(*debianpkg.PackageInfo) error) error {
+	tx, err := db.BeginTx(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lastID int64
+	for {
+		pkgInfo, byID, err := db.getPackages(ctx, tx, "p.id IN (SELECT id FROM packages WHERE id > ? ORDER BY id LIMIT 1000)", lastID)
+		if err != nil {
+			return err
+		}
+		if len(pkgInfo) == 0 {
+			return nil
+		}
+
+		ids := make([]int64, 0, len(byID))
+		for id := range byID {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+
+		for _, id := range ids {
+			err = fn(byID[id])
+			if err != nil {
+				return err
+			}
+		}
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// getPackages returns the packages matching where, with their
+// relationships and extra fields, and the same packages by ID
+func (db *DB) getPackages(ctx context.Context, tx *sql.Tx, where string, args ...any) ([]*debianpkg.PackageInfo, map[int64]*debianpkg.PackageInfo, error) {
+	rows, err := tx.QueryContext(ctx, db.dialect.rebind(packagesQuery+" WHERE "+where+packagesOrder), args...)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer rows.Close()
 
 	pkgInfo := make([]*debianpkg.PackageInfo, 0)
+	byID := make(map[int64]*debianpkg.PackageInfo)
 
 	for rows.Next() {
 		info := new(debianpkg.PackageInfo)
-		info.Maintainer = new(debianpkg.PackageMaintainer)
 
 		var (
-			depends    string
-			predepends string
-			replaces   string
-			conflicts  string
-			suggests   string
+			id                      int64
+			maintainerName          sql.NullString
+			maintainerEmail         sql.NullString
+			originalMaintainerName  sql.NullString
+			originalMaintainerEmail sql.NullString
+			sha256                  sql.NullString
+			size                    sql.NullInt64
+			fileName                sql.NullString
+			md5sum                  sql.NullString
+			sha1                    sql.NullString
+			sha512                  sql.NullString
+			phasedUpdatePercentage  sql.NullInt64
 		)
 
 		err = rows.Scan(
+			&id,
 			&info.Name,
 			&info.Version,
 			&info.Component,
@@ -135,95 +330,279 @@ func (db *DB) GetPackage(pkgName string) ([]*debianpkg.PackageInfo, error) {
 			&info.Architecture,
 			&info.Source,
 			&info.Section,
-			&info.Maintainer.Name,
-			&info.Maintainer.Email,
-			&info.SHA256,
-			&info.Size,
+			&maintainerName,
+			&maintainerEmail,
+			&sha256,
+			&size,
 			&info.InstalledSize,
-			&info.FileName,
-			&depends,
-			&predepends,
-			&replaces,
-			&conflicts,
-			&suggests,
+			&fileName,
 			&info.Description,
+			&info.Priority,
+			&info.MultiArch,
+			&info.Homepage,
+			&originalMaintainerName,
+			&originalMaintainerEmail,
+			&md5sum,
+			&sha1,
+			&sha512,
+			&info.DescriptionMD5,
+			&phasedUpdatePercentage,
 		)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		info.Depends = strings.Split(depends, ", ")
-		info.PreDepends = strings.Split(predepends, ", ")
-		info.Suggests = strings.Split(suggests, ", ")
-		info.Replaces = strings.Split(replaces, ", ")
-		info.Conflicts = strings.Split(conflicts, ", ")
+		// the maintainer is never nil, it's empty if unknown
+		info.Maintainer = &debianpkg.PackageMaintainer{
+			Name:  maintainerName.String,
+			Email: maintainerEmail.String,
+		}
+		if originalMaintainerName.Valid {
+			info.OriginalMaintainer = &debianpkg.PackageMaintainer{
+				Name:  originalMaintainerName.String,
+				Email: originalMaintainerEmail.String,
+			}
+		}
+		if phasedUpdatePercentage.Valid {
+			percentage := int(phasedUpdatePercentage.Int64)
+			info.PhasedUpdatePercentage = &percentage
+		}
+		info.SHA256 = sha256.String
+		info.Size = int(size.Int64)
+		info.FileName = fileName.String
+		info.MD5sum = md5sum.String
+		info.SHA1 = sha1.String
+		info.SHA512 = sha512.String
 
 		pkgInfo = append(pkgInfo, info)
+		byID[id] = info
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows.Close()
+
+	packageIDs := "package_id IN (SELECT p.id FROM packages p WHERE " + where + ")"
+	err = db.getRelations(ctx, tx, byID, packageIDs, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = db.getExtraFields(ctx, tx, byID, packageIDs, args...)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return pkgInfo, rows.Err()
+	return pkgInfo, byID, nil
 }
 
-// PrepareInsertPackage add a statement in the prepared list
-// but do not commit anything to the db
-func (db *DB) PrepareInsertPackage(pkgInfo *debianpkg.PackageInfo) error {
-	var err error
+// getRelations fills the relationship fields of the packages, by ID,
+// from the relations matching where
+func (db *DB) getRelations(ctx context.Context, tx *sql.Tx, byID map[int64]*debianpkg.PackageInfo, where string, args ...any) error {
+	rows, err := tx.QueryContext(ctx, db.dialect.rebind(`SELECT package_id, field, ordinal, name, arch_qualifier,
+			operator, version, restrictions
+		FROM relations
+		WHERE `+where+`
+		ORDER BY package_id, field, ordinal, alternative`), args...)
+	if err != nil {
+		return errors.Wrap(err, "failed to get relations")
+	}
+	defer rows.Close()
 
-	if db.transaction == nil {
-		db.transaction, err = db.Begin()
-		if err != nil {
-			return errors.Wrap(err, "cannot start transaction, something is bad")
-		}
+	fields := make(map[string]func(*debianpkg.PackageInfo) *[]string)
+	for _, field := range relationFields {
+		fields[field.name] = field.values
 	}
 
 	var (
-		maintainerName  string
-		maintainerEmail string
+		lastID      int64
+		lastField   string
+		lastOrdinal = -1
 	)
+	for rows.Next() {
+		var (
+			id      int64
+			field   string
+			ordinal int
+			r       relation
+		)
+		err = rows.Scan(&id, &field, &ordinal, &r.name, &r.archQualifier, &r.operator, &r.version, &r.restrictions)
+		if err != nil {
+			return err
+		}
 
-	if pkgInfo.Maintainer != nil {
-		maintainerName = pkgInfo.Maintainer.Name
-		maintainerEmail = pkgInfo.Maintainer.Email
-	}
-
-	_, err = db.transaction.Exec("INSERT OR REPLACE INTO packages VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		pkgInfo.Name,
-		pkgInfo.Version,
-		pkgInfo.Component,
-		pkgInfo.Suite,
-		pkgInfo.Pocket,
-		pkgInfo.Architecture,
-		pkgInfo.Source,
-		pkgInfo.Section,
-		maintainerName,
-		maintainerEmail,
-		pkgInfo.SHA256,
-		pkgInfo.Size,
-		pkgInfo.InstalledSize,
-		pkgInfo.FileName,
-		strings.Join(pkgInfo.Depends, ", "),
-		strings.Join(pkgInfo.PreDepends, ", "),
-		strings.Join(pkgInfo.Replaces, ", "),
-		strings.Join(pkgInfo.Conflicts, ", "),
-		strings.Join(pkgInfo.Suggests, ", "),
-		pkgInfo.Description,
-	)
+		info, ok := byID[id]
+		values, known := fields[field]
+		if !ok || !known {
+			continue
+		}
 
-	return err
+		list := values(info)
+		if id == lastID && field == lastField && ordinal == lastOrdinal {
+			// another alternative
+			(*list)[len(*list)-1] += " | " + r.String()
+		} else {
+			*list = append(*list, r.String())
+		}
+		lastID, lastField, lastOrdinal = id, field, ordinal
+	}
+
+	return rows.Err()
 }
 
-// InsertPrepared commit the current transaction
-func (db *DB) InsertPrepared() error {
-	if db.transaction == nil {
-		return errors.New("no transaction in progress")
+// getExtraFields fills the extra fields of the packages, by ID, from
+// the extra fields matching where
+func (db *DB) getExtraFields(ctx context.Context, tx *sql.Tx, byID map[int64]*debianpkg.PackageInfo, where string, args ...any) error {
+	rows, err := tx.QueryContext(ctx, db.dialect.rebind(`SELECT package_id, field, value
+		FROM extra_fields
+		WHERE `+where), args...)
+	if err != nil {
+		return errors.Wrap(err, "failed to get extra fields")
 	}
+	defer rows.Close()
 
-	err := db.transaction.Commit()
+	for rows.Next() {
+		var (
+			id    int64
+			field string
+			value string
+		)
+		err = rows.Scan(&id, &field, &value)
+		if err != nil {
+			return err
+		}
+
+		info, ok := byID[id]
+		if !ok {
+			continue
+		}
+		if info.Extra == nil {
+			info.Extra = make(map[string]string)
+		}
+		info.Extra[field] = value
+	}
+
+	return rows.Err()
+}
+
+// GetProviders returns the packages providing a virtual package
+func (db *DB) GetProviders(ctx context.Context, virtualName string) ([]*debianpkg.Provider, error) {
+	rows, err := db.QueryContext(ctx, db.dialect.rebind(`SELECT p.name, p.version, p.component, p.suite, p.pocket,
+			p.architecture, r.version
+		FROM relations r JOIN packages p ON p.id = r.package_id
+		WHERE r.field = 'Provides' AND r.name = ?
+		ORDER BY p.suite, p.pocket, p.name, p.component, p.architecture`), virtualName)
 	if err != nil {
-		db.transaction.Rollback()
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	db.transaction = nil
-	return nil
+	providers := make([]*debianpkg.Provider, 0)
+	for rows.Next() {
+		provider := new(debianpkg.Provider)
+		err = rows.Scan(
+			&provider.Name,
+			&provider.Version,
+			&provider.Component,
+			&provider.Suite,
+			&provider.Pocket,
+			&provider.Architecture,
+			&provider.ProvidedVersion,
+		)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	return providers, rows.Err()
+}
+
+// SearchPackages returns the names of the packages starting with prefix
+func (db *DB) SearchPackages(ctx context.Context, prefix string, limit int) ([]string, error) {
+	rows, err := db.QueryContext(ctx,
+		db.dialect.rebind(`SELECT DISTINCT name FROM packages WHERE name LIKE ? ESCAPE '\' ORDER BY name LIMIT ?`),
+		escapeLike(prefix)+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// Begin starts a Writer. With SQLite, the writers wait for each other:
+// only one of them can write at a time.
+func (db *DB) Begin(ctx context.Context) (Writer, error) {
+	b, err := newBatch(ctx, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot start transaction, something is bad")
+	}
+
+	return b, nil
+}
+
+// Size returns the size of the database in bytes
+func (db *DB) Size(ctx context.Context) (int64, error) {
+	var size int64
+	err := db.QueryRowContext(ctx, db.dialect.sizeQuery).Scan(&size)
+
+	return size, err
+}
+
+// RowCounts returns the number of rows in each table
+func (db *DB) RowCounts(ctx context.Context) (map[string]int64, error) {
+	tx, err := db.BeginTx(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	counts := make(map[string]int64)
+	for _, table := range []string{db.tableName, "maintainers", "files", "relations", "extra_fields", "release_state"} {
+		var n int64
+		err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to count rows of %v", table)
+		}
+		counts[table] = n
+	}
+
+	return counts, nil
+}
+
+// CountPackagesPerPocket returns the number of packages in each pocket
+// (eg. "jammy-updates")
+func (db *DB) CountPackagesPerPocket(ctx context.Context) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT suite, pocket, COUNT(*) FROM packages GROUP BY suite, pocket")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var (
+			suite  string
+			pocket string
+			n      int64
+		)
+		err = rows.Scan(&suite, &pocket, &n)
+		if err != nil {
+			return nil, err
+		}
+		counts[suite+pocket] = n
+	}
+
+	return counts, rows.Err()
 }
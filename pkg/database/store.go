@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gjolly/go-rmadison/pkg/debianpkg"
+	"github.com/pkg/errors"
+)
+
+// Store is where the packages of an archive are saved
+type Store interface {
+	// Begin starts a Writer, several of them can be used at once
+	Begin(ctx context.Context) (Writer, error)
+
+	// GetPackage returns the package in every pocket, component and
+	// architecture
+	GetPackage(ctx context.Context, pkgName string) ([]*debianpkg.PackageInfo, error)
+	// GetProviders returns the packages providing a virtual package,
+	// sorted by pocket and name
+	GetProviders(ctx context.Context, virtualName string) ([]*debianpkg.Provider, error)
+	// SearchPackages returns the names of the packages starting with
+	// prefix, sorted, at most limit of them
+	SearchPackages(ctx context.Context, prefix string, limit int) ([]string, error)
+	// ForEachPackage calls fn with every package until it returns an
+	// error. The packages are those of a snapshot of the store.
+	ForEachPackage(ctx context.Context, fn func(*debianpkg.PackageInfo) error) error
+	// CountPackagesPerPocket returns the number of packages in each
+	// pocket (eg. "jammy-updates")
+	CountPackagesPerPocket(ctx context.Context) (map[string]int64, error)
+	// DeletePocket removes the packages of a pocket and its release
+	// state in archive. The packages don't record their archive, a
+	// store only holds one archive.
+	DeletePocket(ctx context.Context, archive, pocket string) error
+
+	// GetReleaseState returns the state of the Release file of the
+	// pocket of archive, nil if unknown
+	GetReleaseState(ctx context.Context, archive, pocket string) (*ReleaseState, error)
+	// GetReleaseStates returns the state of the Release file of every
+	// pocket of archive, sorted by pocket
+	GetReleaseStates(ctx context.Context, archive string) ([]*ReleaseState, error)
+	// SetReleaseState saves the state of the Release file of a pocket
+	SetReleaseState(ctx context.Context, state *ReleaseState) error
+
+	// Size returns the size of the store in bytes
+	Size(ctx context.Context) (int64, error)
+	// RowCounts returns the number of rows in each table
+	RowCounts(ctx context.Context) (map[string]int64, error)
+
+	Close() error
+}
+
+// Writer writes packages in its own transaction, they are only visible
+// once it's committed. A Writer can be used from several goroutines.
+type Writer interface {
+	// InsertPackage adds a package, replacing the one with the same
+	// name, component, suite, pocket and architecture
+	InsertPackage(ctx context.Context, pkgInfo *debianpkg.PackageInfo) error
+	// Commit makes the packages visible
+	Commit() error
+	// Rollback discards the packages, it does nothing if the Writer was
+	// already committed
+	Rollback() error
+}
+
+// ErrWriterClosed is returned when using a Writer already committed or
+// rolled back
+var ErrWriterClosed = errors.New("writer already committed or rolled back")
+
+var (
+	_ Store  = (*DB)(nil)
+	_ Store  = (*Memory)(nil)
+	_ Writer = (*batch)(nil)
+	_ Writer = (*memoryWriter)(nil)
+)
+
+// MemoryDataSource is the data source of the in-memory store
+const MemoryDataSource = "memory:"
+
+// Open opens the store of a data source: the in-memory store for
+// MemoryDataSource, otherwise a SQL database, see Driver
+func Open(dataSource string) (Store, error) {
+	if dataSource == MemoryDataSource {
+		return NewMemory(), nil
+	}
+
+	db, err := NewConn(Driver(dataSource), dataSource)
+	if err != nil {
+		// not a nil *DB in a non-nil Store
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, using \ as the
+// escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -3,6 +3,7 @@ package debianpkg
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -13,6 +14,10 @@ type PackageMaintainer struct {
 	Email string `json:"email"`
 }
 
+func (m *PackageMaintainer) String() string {
+	return fmt.Sprintf("%v <%v>", m.Name, m.Email)
+}
+
 // PackageInfo holds the metadata for a debian package
 type PackageInfo struct {
 	Name          string             `json:"name"`
@@ -33,77 +38,278 @@ type PackageInfo struct {
 	Replaces      []string           `json:"replaces"`
 	Conflicts     []string           `json:"conflicts"`
 	Suggests      []string           `json:"suggests"`
-	Description   string             `json:"description"`
+	// Description is the synopsis, followed by the extended
+	// description if any, its lines starting with a space
+	Description string `json:"description"`
+
+	Provides           []string           `json:"provides,omitempty"`
+	Recommends         []string           `json:"recommends,omitempty"`
+	Breaks             []string           `json:"breaks,omitempty"`
+	Enhances           []string           `json:"enhances,omitempty"`
+	BuiltUsing         []string           `json:"built-using,omitempty"`
+	Task               []string           `json:"task,omitempty"`
+	MultiArch          string             `json:"multi-arch,omitempty"`
+	Priority           string             `json:"priority,omitempty"`
+	Homepage           string             `json:"homepage,omitempty"`
+	OriginalMaintainer *PackageMaintainer `json:"original-maintainer,omitempty"`
+	MD5sum             string             `json:"md5sum,omitempty"`
+	SHA1               string             `json:"sha1,omitempty"`
+	SHA512             string             `json:"sha512,omitempty"`
+	DescriptionMD5     string             `json:"description-md5,omitempty"`
+	// PhasedUpdatePercentage is nil if the update isn't phased
+	PhasedUpdatePercentage *int `json:"phased-update-percentage,omitempty"`
+	// Extra are the fields not listed above, by name
+	Extra map[string]string `json:"extra,omitempty"`
 }
 
-// Set sets a field on the object
-func (pkgInfo *PackageInfo) Set(key, value string) error {
-	if key == "Version" {
-		pkgInfo.Version = value
-		return nil
+// Provider is a package providing a virtual package, eg. postfix for
+// mail-transport-agent
+type Provider struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Component    string `json:"component"`
+	Suite        string `json:"suite"`
+	Pocket       string `json:"pocket"`
+	Architecture string `json:"architecture"`
+	// ProvidedVersion is the version of the virtual package provided,
+	// empty if the Provides isn't versioned
+	ProvidedVersion string `json:"provided-version,omitempty"`
+}
+
+var maintainerRegexp = regexp.MustCompile(`(?P<name>.*) <(?P<email>.*)>`)
+
+func parseMaintainer(value string) (*PackageMaintainer, error) {
+	matches := maintainerRegexp.FindStringSubmatch(value)
+	if len(matches) != 3 {
+		return nil, fmt.Errorf("Unable to read maintainer info %v", value)
 	}
-	if key == "Source" {
-		pkgInfo.Source = value
-		return nil
+
+	return &PackageMaintainer{
+		Name:  matches[1],
+		Email: matches[2],
+	}, nil
+}
+
+// splitList splits a comma separated field, eg. Depends. Empty values
+// are dropped.
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
 	}
-	if key == "Section" {
-		pkgInfo.Section = value
+	if len(list) == 0 {
 		return nil
 	}
-	if key == "Size" {
+
+	return list
+}
+
+// Set sets a field on the object, the fields without their own
+// attribute are kept in Extra
+func (pkgInfo *PackageInfo) Set(key, value string) error {
+	var err error
+
+	switch key {
+	case "Package":
+		pkgInfo.Name = value
+	case "Architecture":
+		// the architecture of the package index is kept, eg. amd64 for
+		// the Architecture: all packages of binary-amd64
+		if pkgInfo.Architecture != "" && pkgInfo.Architecture != value {
+			pkgInfo.setExtra(key, value)
+		} else {
+			pkgInfo.Architecture = value
+		}
+	case "Version":
+		pkgInfo.Version = value
+	case "Source":
+		pkgInfo.Source = value
+	case "Section":
+		pkgInfo.Section = value
+	case "Size":
 		pkgInfo.Size, _ = strconv.Atoi(value)
-		return nil
-	}
-	if key == "Installed-Size" {
+	case "Installed-Size":
 		pkgInfo.InstalledSize, _ = strconv.Atoi(value)
-		return nil
+	case "Depends":
+		pkgInfo.Depends = splitList(value)
+	case "Pre-Depends":
+		pkgInfo.PreDepends = splitList(value)
+	case "Conflicts":
+		pkgInfo.Conflicts = splitList(value)
+	case "Replaces":
+		pkgInfo.Replaces = splitList(value)
+	case "Suggests":
+		pkgInfo.Suggests = splitList(value)
+	case "Provides":
+		pkgInfo.Provides = splitList(value)
+	case "Recommends":
+		pkgInfo.Recommends = splitList(value)
+	case "Breaks":
+		pkgInfo.Breaks = splitList(value)
+	case "Enhances":
+		pkgInfo.Enhances = splitList(value)
+	case "Built-Using":
+		pkgInfo.BuiltUsing = splitList(value)
+	case "Task":
+		pkgInfo.Task = splitList(value)
+	case "Multi-Arch":
+		pkgInfo.MultiArch = value
+	case "Priority":
+		pkgInfo.Priority = value
+	case "Homepage":
+		pkgInfo.Homepage = value
+	case "MD5sum":
+		pkgInfo.MD5sum = value
+	case "SHA1":
+		pkgInfo.SHA1 = value
+	case "SHA256":
+		pkgInfo.SHA256 = value
+	case "SHA512":
+		pkgInfo.SHA512 = value
+	case "Description":
+		pkgInfo.Description = value
+	case "Description-md5":
+		pkgInfo.DescriptionMD5 = value
+	case "Filename":
+		pkgInfo.FileName = value
+	case "Phased-Update-Percentage":
+		percentage, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid Phased-Update-Percentage %v", value)
+		}
+		pkgInfo.PhasedUpdatePercentage = &percentage
+	case "Maintainer":
+		pkgInfo.Maintainer, err = parseMaintainer(value)
+	case "Original-Maintainer":
+		pkgInfo.OriginalMaintainer, err = parseMaintainer(value)
+	default:
+		pkgInfo.setExtra(key, value)
 	}
-	if key == "Depends" {
-		pkgInfo.Depends = strings.Split(value, ", ")
-		return nil
+
+	return err
+}
+
+func (pkgInfo *PackageInfo) setExtra(key, value string) {
+	if pkgInfo.Extra == nil {
+		pkgInfo.Extra = make(map[string]string)
 	}
-	if key == "Pre-Depends" {
-		pkgInfo.PreDepends = strings.Split(value, ", ")
-		return nil
+	pkgInfo.Extra[key] = value
+}
+
+// Stanza writes the package back as a paragraph of a Packages file. The
+// fields are in the order used by the Ubuntu archive, the extra fields
+// last.
+func (pkgInfo *PackageInfo) Stanza() string {
+	var b strings.Builder
+	field := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%v: %v\n", key, value)
+		}
 	}
-	if key == "Conflicts" {
-		pkgInfo.Conflicts = strings.Split(value, ", ")
-		return nil
+	list := func(key string, values []string) {
+		field(key, strings.Join(values, ", "))
 	}
-	if key == "Replaces" {
-		pkgInfo.Replaces = strings.Split(value, ", ")
-		return nil
+	// the maintainers read from a database are empty rather than nil
+	maintainer := func(key string, m *PackageMaintainer) {
+		if m != nil && *m != (PackageMaintainer{}) {
+			field(key, m.String())
+		}
 	}
-	if key == "Suggests" {
-		pkgInfo.Suggests = strings.Split(value, ", ")
-		return nil
+	number := func(key string, n int) {
+		if n != 0 {
+			field(key, strconv.Itoa(n))
+		}
 	}
-	if key == "SHA256" {
-		pkgInfo.SHA256 = value
-		return nil
+
+	field("Package", pkgInfo.Name)
+	if arch, ok := pkgInfo.Extra["Architecture"]; ok {
+		field("Architecture", arch)
+	} else {
+		field("Architecture", pkgInfo.Architecture)
 	}
-	if key == "Description" {
-		pkgInfo.Description = value
-		return nil
+	field("Version", pkgInfo.Version)
+	field("Multi-Arch", pkgInfo.MultiArch)
+	field("Priority", pkgInfo.Priority)
+	field("Section", pkgInfo.Section)
+	field("Source", pkgInfo.Source)
+	maintainer("Maintainer", pkgInfo.Maintainer)
+	maintainer("Original-Maintainer", pkgInfo.OriginalMaintainer)
+	number("Installed-Size", pkgInfo.InstalledSize)
+	list("Provides", pkgInfo.Provides)
+	list("Pre-Depends", pkgInfo.PreDepends)
+	list("Depends", pkgInfo.Depends)
+	list("Recommends", pkgInfo.Recommends)
+	list("Suggests", pkgInfo.Suggests)
+	list("Enhances", pkgInfo.Enhances)
+	list("Breaks", pkgInfo.Breaks)
+	list("Conflicts", pkgInfo.Conflicts)
+	list("Replaces", pkgInfo.Replaces)
+	list("Built-Using", pkgInfo.BuiltUsing)
+	field("Filename", pkgInfo.FileName)
+	number("Size", pkgInfo.Size)
+	field("MD5sum", pkgInfo.MD5sum)
+	field("SHA1", pkgInfo.SHA1)
+	field("SHA256", pkgInfo.SHA256)
+	field("SHA512", pkgInfo.SHA512)
+	field("Homepage", pkgInfo.Homepage)
+	field("Description", pkgInfo.Description)
+	list("Task", pkgInfo.Task)
+	field("Description-md5", pkgInfo.DescriptionMD5)
+	if pkgInfo.PhasedUpdatePercentage != nil {
+		field("Phased-Update-Percentage", strconv.Itoa(*pkgInfo.PhasedUpdatePercentage))
 	}
-	if key == "Filename" {
-		pkgInfo.FileName = value
-		return nil
+
+	keys := make([]string, 0, len(pkgInfo.Extra))
+	for key := range pkgInfo.Extra {
+		if key != "Architecture" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field(key, pkgInfo.Extra[key])
 	}
-	if key == "Maintainer" {
-		re := regexp.MustCompile(`(?P<name>.*) <(?P<email>.*)>`)
-		matches := re.FindStringSubmatch(value)
-		if len(matches) != 3 {
-			return fmt.Errorf("Unable to read maintainer info %v", value)
+
+	return b.String()
+}
+
+// Field is a field of a paragraph of a control file
+type Field struct {
+	Key   string
+	Value string
+}
+
+// ParseFields splits a paragraph of a control file, eg. a package of a
+// Packages file, in fields. The continuation lines of a multiline field
+// are kept in its value, with their leading space.
+func ParseFields(paragraph string) []Field {
+	fields := make([]Field, 0)
+	for _, line := range strings.Split(paragraph, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
 		}
 
-		pkgInfo.Maintainer = &PackageMaintainer{
-			Name:  matches[1],
-			Email: matches[2],
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) != 0 {
+				fields[len(fields)-1].Value += "\n" + line
+			}
+			continue
 		}
 
-		return nil
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		// the paragraph is usually part of a large file that
+		// shouldn't be kept in memory by the fields
+		fields = append(fields, Field{
+			Key:   strings.Clone(key),
+			Value: strings.Clone(strings.TrimSpace(value)),
+		})
 	}
 
-	return nil
+	return fields
 }
@@ -0,0 +1,114 @@
+package debianpkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+const postfixStanza = `Package: postfix
+Architecture: amd64
+Version: 3.8.6-1build2
+Multi-Arch: foreign
+Priority: optional
+Section: mail
+Origin: Ubuntu
+Maintainer: Ubuntu Developers <ubuntu-devel-discuss@lists.ubuntu.com>
+Original-Maintainer: LaMont Jones <lamont@debian.org>
+Bugs: https://bugs.launchpad.net/ubuntu/+filebug
+Installed-Size: 4256
+Provides: default-mta, mail-transport-agent
+Pre-Depends: init-system-helpers (>= 1.54~)
+Depends: debconf (>= 0.5) | debconf-2.0, cpio, netbase, adduser (>= 3.48), dpkg (>= 1.8.3),
+ libc6 (>= 2.38), ssl-cert
+Recommends: python3
+Suggests: procmail, postfix-mysql
+Conflicts: mail-transport-agent
+Breaks: postfix-lmdb (<< 3.8.6-1build2)
+Replaces: mail-transport-agent
+Filename: pool/main/p/postfix/postfix_3.8.6-1build2_amd64.deb
+Size: 1254962
+MD5sum: 5d2a4a6a4b9c2d3e1f0a9b8c7d6e5f40
+SHA1: 0123456789abcdef0123456789abcdef01234567
+SHA256: 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+SHA512: 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+Homepage: https://www.postfix.org
+Description: High-performance mail transport agent
+ Postfix is Wietse Venema's mail transport agent.
+ .
+ It is fast, easy to administer, and secure.
+Task: mail-server
+Description-md5: 1a2b3c4d5e6f708192a3b4c5d6e7f809
+Phased-Update-Percentage: 0
+`
+
+func parseStanza(t *testing.T, stanza string) *PackageInfo {
+	pkgInfo := &PackageInfo{Architecture: "amd64"}
+	for _, field := range ParseFields(stanza) {
+		err := pkgInfo.Set(field.Key, field.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return pkgInfo
+}
+
+func TestSet(t *testing.T) {
+	pkgInfo := parseStanza(t, postfixStanza)
+
+	expectedDepends := []string{
+		"debconf (>= 0.5) | debconf-2.0", "cpio", "netbase", "adduser (>= 3.48)",
+		"dpkg (>= 1.8.3)", "libc6 (>= 2.38)", "ssl-cert",
+	}
+	if !reflect.DeepEqual(pkgInfo.Depends, expectedDepends) {
+		t.Errorf("expected %q, got %q", expectedDepends, pkgInfo.Depends)
+	}
+	if !reflect.DeepEqual(pkgInfo.Provides, []string{"default-mta", "mail-transport-agent"}) {
+		t.Errorf("unexpected Provides %q", pkgInfo.Provides)
+	}
+	if pkgInfo.OriginalMaintainer == nil || pkgInfo.OriginalMaintainer.Email != "lamont@debian.org" {
+		t.Errorf("unexpected Original-Maintainer %+v", pkgInfo.OriginalMaintainer)
+	}
+	if pkgInfo.PhasedUpdatePercentage == nil || *pkgInfo.PhasedUpdatePercentage != 0 {
+		t.Errorf("unexpected Phased-Update-Percentage %v", pkgInfo.PhasedUpdatePercentage)
+	}
+
+	expectedDescription := "High-performance mail transport agent\n" +
+		" Postfix is Wietse Venema's mail transport agent.\n" +
+		" .\n" +
+		" It is fast, easy to administer, and secure."
+	if pkgInfo.Description != expectedDescription {
+		t.Errorf("expected %q, got %q", expectedDescription, pkgInfo.Description)
+	}
+
+	expectedExtra := map[string]string{
+		"Origin": "Ubuntu",
+		"Bugs":   "https://bugs.launchpad.net/ubuntu/+filebug",
+	}
+	if !reflect.DeepEqual(pkgInfo.Extra, expectedExtra) {
+		t.Errorf("expected %v, got %v", expectedExtra, pkgInfo.Extra)
+	}
+
+	if pkgInfo.PreDepends == nil || pkgInfo.Replaces == nil || pkgInfo.Enhances != nil {
+		t.Errorf("unexpected relations: %+v", pkgInfo)
+	}
+}
+
+func TestStanza(t *testing.T) {
+	pkgInfo := parseStanza(t, postfixStanza)
+
+	// nothing is lost when writing the package back
+	roundTrip := parseStanza(t, pkgInfo.Stanza())
+	if !reflect.DeepEqual(roundTrip, pkgInfo) {
+		t.Errorf("expected %+v, got %+v", pkgInfo, roundTrip)
+	}
+
+	allPkg := parseStanza(t, "Package: tzdata\nArchitecture: all\nVersion: 2024a-2ubuntu1\n")
+	if allPkg.Architecture != "amd64" {
+		t.Errorf("expected the architecture of the index to be kept, got %v", allPkg.Architecture)
+	}
+	expected := "Package: tzdata\nArchitecture: all\nVersion: 2024a-2ubuntu1\n"
+	if stanza := allPkg.Stanza(); stanza != expected {
+		t.Errorf("expected %q, got %q", expected, stanza)
+	}
+}